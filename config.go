@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/general252/rtsp_to_webrtc/pkg"
+	"github.com/pion/webrtc/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// 配置文件, 格式参考 rtsp-simple-server.yml
+
+// defaultConfigPath 默认配置文件, 不存在时使用默认配置
+const defaultConfigPath = "rtsp_to_webrtc.yml"
+
+// defaultShutdownTimeout 默认退出等待时间
+const defaultShutdownTimeout = 10 * time.Second
+
+// stringDuration 配置文件中的时长, 如 10s
+type stringDuration time.Duration
+
+func (d *stringDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = stringDuration(v)
+	return nil
+}
+
+// iceServerConf STUN/TURN服务器
+type iceServerConf struct {
+	URLs       []string       `yaml:"urls"`
+	Username   string         `yaml:"username"`
+	Credential string         `yaml:"credential"`
+	Secret     string         `yaml:"secret"`
+	TTL        stringDuration `yaml:"ttl"`
+}
+
+// turnConf 内置TURN服务器
+type turnConf struct {
+	Enable   bool           `yaml:"enable"`
+	PublicIP string         `yaml:"publicIP"`
+	Port     int            `yaml:"port"`
+	Realm    string         `yaml:"realm"`
+	TTL      stringDuration `yaml:"ttl"`
+}
+
+// pathConf 一路流, rtsp参数为空时使用全局参数
+type pathConf struct {
+	Source              string         `yaml:"source"`
+	SourceProtocol      string         `yaml:"sourceProtocol"`
+	SourceAnyPortEnable bool           `yaml:"sourceAnyPortEnable"`
+	ReadTimeout         stringDuration `yaml:"readTimeout"`
+	WriteTimeout        stringDuration `yaml:"writeTimeout"`
+	ReadBufferCount     int            `yaml:"readBufferCount"`
+	WriteBufferCount    int            `yaml:"writeBufferCount"`
+
+	// 用户名密码, 密码可以放在单独的文件中 (如 docker secrets)
+	SourceUser     string `yaml:"sourceUser"`
+	SourcePass     string `yaml:"sourcePass"`
+	SourcePassFile string `yaml:"sourcePassFile"`
+	// rtsps
+	SourceFingerprint string `yaml:"sourceFingerprint"`
+	SourceCAFile      string `yaml:"sourceCAFile"`
+}
+
+// rtpInputConf UDP RTP输入
+type rtpInputConf struct {
+	Address string `yaml:"address"`
+	Codec   string `yaml:"codec"`
+}
+
+// rtspConfig 路径的rtsp参数, 未设置的项使用defaults
+func (tis *pathConf) rtspConfig(defaults pkg.RtspConfig) (pkg.RtspConfig, error) {
+	config := defaults
+	if tis.SourceProtocol != "" {
+		config.Transport = tis.SourceProtocol
+	}
+	if tis.SourceAnyPortEnable {
+		config.AnyPortEnable = true
+	}
+	if tis.ReadTimeout != 0 {
+		config.ReadTimeout = time.Duration(tis.ReadTimeout)
+	}
+	if tis.WriteTimeout != 0 {
+		config.WriteTimeout = time.Duration(tis.WriteTimeout)
+	}
+	if tis.ReadBufferCount != 0 {
+		config.ReadBufferCount = tis.ReadBufferCount
+	}
+	if tis.WriteBufferCount != 0 {
+		config.WriteBufferCount = tis.WriteBufferCount
+	}
+
+	config.Username, config.Password = tis.SourceUser, tis.SourcePass
+	if tis.SourcePassFile != "" {
+		data, err := os.ReadFile(tis.SourcePassFile)
+		if err != nil {
+			return config, err
+		}
+		config.Password = strings.TrimSpace(string(data))
+	}
+	config.Fingerprint, config.CAFile = tis.SourceFingerprint, tis.SourceCAFile
+
+	return config, nil
+}
+
+// serverConfig 配置文件
+type serverConfig struct {
+	// http
+	HTTPAddress string `yaml:"httpAddress"`
+	AuthUser    string `yaml:"authUser"`
+	AuthPass    string `yaml:"authPass"`
+	// websocket信令允许的跨站Origin
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+	// 退出时等待连接断开的最长时间
+	ShutdownTimeout stringDuration `yaml:"shutdownTimeout"`
+
+	// webrtc
+	WebrtcAddress        string            `yaml:"webrtcAddress"`
+	WebrtcTCPPort        int               `yaml:"webrtcTCPPort"`
+	ICEServers           []iceServerConf   `yaml:"iceServers"`
+	TURN                 turnConf          `yaml:"turn"`
+	NAT1To1IPs           []string          `yaml:"nat1To1IPs"`
+	NAT1To1CandidateType string            `yaml:"nat1To1CandidateType"`
+	InterfacePublicIPs   map[string]string `yaml:"interfacePublicIPs"`
+	Interfaces           []string          `yaml:"interfaces"`
+
+	// 内置rtsp服务器
+	RTSP        bool   `yaml:"rtsp"`
+	RTSPAddress string `yaml:"rtspAddress"`
+	RTPAddress  string `yaml:"rtpAddress"`
+	RTCPAddress string `yaml:"rtcpAddress"`
+
+	// rtsp
+	ReadTimeout         stringDuration `yaml:"readTimeout"`
+	WriteTimeout        stringDuration `yaml:"writeTimeout"`
+	ReadBufferCount     int            `yaml:"readBufferCount"`
+	WriteBufferCount    int            `yaml:"writeBufferCount"`
+	SourceProtocol      string         `yaml:"sourceProtocol"`
+	SourceAnyPortEnable bool           `yaml:"sourceAnyPortEnable"`
+
+	RtspServer     string              `yaml:"rtspServer"`
+	AllowedSources []string            `yaml:"allowedSources"`
+	SourceLinger   stringDuration      `yaml:"sourceLinger"`
+	SourceRetryMin stringDuration      `yaml:"sourceRetryMin"`
+	SourceRetryMax stringDuration      `yaml:"sourceRetryMax"`
+	Paths          map[string]pathConf `yaml:"paths"`
+
+	// rtp
+	RTPInputs map[string]rtpInputConf `yaml:"rtpInputs"`
+}
+
+// defaultConfig 默认配置
+func defaultConfig() *serverConfig {
+	return &serverConfig{
+		HTTPAddress:          ":8080",
+		ShutdownTimeout:      stringDuration(defaultShutdownTimeout),
+		WebrtcAddress:        pkg.DefaultListenAddress,
+		NAT1To1CandidateType: "host",
+		RTSPAddress:          pkg.DefaultRtspAddress,
+		ReadTimeout:          stringDuration(10 * time.Second),
+		WriteTimeout:         stringDuration(10 * time.Second),
+		ReadBufferCount:      256,
+		WriteBufferCount:     256,
+		SourceProtocol:       pkg.RtspTransportAuto,
+		RtspServer:           pkg.RtspServer,
+		SourceLinger:         stringDuration(pkg.DefaultSourceLinger),
+		SourceRetryMin:       stringDuration(pkg.DefaultSourceRetryMin),
+		SourceRetryMax:       stringDuration(pkg.DefaultSourceRetryMax),
+	}
+}
+
+// loadConfig 读取配置文件, required为false时文件不存在使用默认配置
+func loadConfig(path string, required bool) (*serverConfig, error) {
+	conf := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return conf, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = yaml.UnmarshalStrict(data, conf); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return conf, nil
+}
+
+// engineOptions 配置转换为 WebRtcEngine 选项
+func (tis *serverConfig) engineOptions() ([]pkg.Option, error) {
+	opts := []pkg.Option{
+		pkg.WithListenAddress(tis.WebrtcAddress),
+		pkg.WithRtspServer(tis.RtspServer),
+		pkg.WithSourceLinger(time.Duration(tis.SourceLinger)),
+		pkg.WithSourceRetry(time.Duration(tis.SourceRetryMin), time.Duration(tis.SourceRetryMax)),
+	}
+
+	if tis.WebrtcTCPPort > 0 {
+		opts = append(opts, pkg.WithICETCPPort(tis.WebrtcTCPPort))
+	}
+
+	for _, server := range tis.ICEServers {
+		opts = append(opts, pkg.WithICEServers(pkg.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+			Secret:     server.Secret,
+			TTL:        time.Duration(server.TTL),
+		}))
+	}
+
+	if tis.TURN.Enable {
+		opts = append(opts, pkg.WithTURNServer(pkg.TURNConfig{
+			PublicIP: tis.TURN.PublicIP,
+			Port:     tis.TURN.Port,
+			Realm:    tis.TURN.Realm,
+			TTL:      time.Duration(tis.TURN.TTL),
+		}))
+	}
+
+	if len(tis.NAT1To1IPs) > 0 || len(tis.InterfacePublicIPs) > 0 {
+		var candidateType webrtc.ICECandidateType
+		switch strings.ToLower(tis.NAT1To1CandidateType) {
+		case "", "host":
+			candidateType = webrtc.ICECandidateTypeHost
+		default:
+			// 只支持host, srflx候选地址不经过UDP mux
+			return nil, fmt.Errorf("invalid nat1To1CandidateType '%s'", tis.NAT1To1CandidateType)
+		}
+		opts = append(opts, pkg.WithNAT1To1IPs(candidateType, tis.NAT1To1IPs...))
+
+		for iface, publicIP := range tis.InterfacePublicIPs {
+			opts = append(opts, pkg.WithInterfacePublicIP(iface, publicIP))
+		}
+	}
+
+	if len(tis.Interfaces) > 0 {
+		interfaces := map[string]bool{}
+		for _, iface := range tis.Interfaces {
+			interfaces[iface] = true
+		}
+		opts = append(opts, pkg.WithInterfaceFilter(func(iface string) bool {
+			return interfaces[iface]
+		}))
+	}
+
+	if len(tis.AllowedOrigins) > 0 {
+		opts = append(opts, pkg.WithAllowedOrigins(tis.AllowedOrigins...))
+	}
+
+	if len(tis.AllowedSources) > 0 {
+		opts = append(opts, pkg.WithAllowedSources(tis.AllowedSources...))
+	}
+
+	rtspConfig := pkg.RtspConfig{
+		Transport:        tis.SourceProtocol,
+		AnyPortEnable:    tis.SourceAnyPortEnable,
+		ReadTimeout:      time.Duration(tis.ReadTimeout),
+		WriteTimeout:     time.Duration(tis.WriteTimeout),
+		ReadBufferCount:  tis.ReadBufferCount,
+		WriteBufferCount: tis.WriteBufferCount,
+	}
+	opts = append(opts, pkg.WithRtspConfig(rtspConfig))
+
+	if tis.RTSP {
+		opts = append(opts, pkg.WithRtspListen(pkg.RtspListenConfig{
+			Address:        tis.RTSPAddress,
+			UDPRTPAddress:  tis.RTPAddress,
+			UDPRTCPAddress: tis.RTCPAddress,
+			ReadTimeout:    time.Duration(tis.ReadTimeout),
+			WriteTimeout:   time.Duration(tis.WriteTimeout),
+			User:           tis.AuthUser,
+			Pass:           tis.AuthPass,
+		}))
+	}
+
+	if len(tis.Paths) > 0 {
+		paths := map[string]string{}
+		for name, path := range tis.Paths {
+			config, err := path.rtspConfig(rtspConfig)
+			if err != nil {
+				return nil, fmt.Errorf("path %s: %w", name, err)
+			}
+			paths[name] = path.Source
+			opts = append(opts, pkg.WithSourceRtspConfig(path.Source, config))
+		}
+		opts = append(opts, pkg.WithPaths(paths))
+	}
+
+	for name, input := range tis.RTPInputs {
+		opts = append(opts, pkg.WithRTPInputs(pkg.RTPInput{
+			Name:    name,
+			Address: input.Address,
+			Codec:   input.Codec,
+		}))
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/general252/rtsp_to_webrtc/pkg"
+)
+
+// writeConfig 临时配置文件
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "rtsp_to_webrtc.yml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.yml")
+
+	tests := []struct {
+		name     string
+		path     string
+		required bool
+		wantErr  bool
+		check    func(t *testing.T, conf *serverConfig)
+	}{
+		{
+			name: "missing file uses defaults",
+			path: missing,
+			check: func(t *testing.T, conf *serverConfig) {
+				if conf.HTTPAddress != ":8080" || time.Duration(conf.ShutdownTimeout) != defaultShutdownTimeout {
+					t.Errorf("conf = %+v, want defaults", conf)
+				}
+			},
+		},
+		{
+			name:     "missing required file",
+			path:     missing,
+			required: true,
+			wantErr:  true,
+		},
+		{
+			name: "overrides",
+			path: writeConfig(t, "httpAddress: :9090\n"+
+				"sourceLinger: 30s\n"+
+				"paths:\n"+
+				"  cam1:\n"+
+				"    source: rtsp://192.168.1.10/stream1\n"+
+				"    sourceProtocol: tcp\n"),
+			check: func(t *testing.T, conf *serverConfig) {
+				if conf.HTTPAddress != ":9090" {
+					t.Errorf("HTTPAddress = %q", conf.HTTPAddress)
+				}
+				if time.Duration(conf.SourceLinger) != 30*time.Second {
+					t.Errorf("SourceLinger = %v", time.Duration(conf.SourceLinger))
+				}
+				// 未设置的项保持默认值
+				if conf.WebrtcAddress != pkg.DefaultListenAddress {
+					t.Errorf("WebrtcAddress = %q", conf.WebrtcAddress)
+				}
+				if path := conf.Paths["cam1"]; path.Source != "rtsp://192.168.1.10/stream1" || path.SourceProtocol != "tcp" {
+					t.Errorf("Paths[cam1] = %+v", path)
+				}
+			},
+		},
+		{
+			name:    "unknown field",
+			path:    writeConfig(t, "httpAdress: :9090\n"),
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			path:    writeConfig(t, "shutdownTimeout: 10\n"),
+			wantErr: true,
+		},
+		{
+			name: "shipped config",
+			path: defaultConfigPath,
+			check: func(t *testing.T, conf *serverConfig) {
+				if _, err := conf.engineOptions(); err != nil {
+					t.Error(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := loadConfig(tt.path, tt.required)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loadConfig() should fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, conf)
+		})
+	}
+}
+
+func TestPathRtspConfig(t *testing.T) {
+	passFile := filepath.Join(t.TempDir(), "pass")
+	if err := os.WriteFile(passFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := pkg.RtspConfig{
+		Transport:       pkg.RtspTransportAuto,
+		ReadTimeout:     10 * time.Second,
+		ReadBufferCount: 256,
+	}
+
+	tests := []struct {
+		name    string
+		path    pathConf
+		want    pkg.RtspConfig
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			path: pathConf{Source: "rtsp://host/a"},
+			want: defaults,
+		},
+		{
+			name: "overrides",
+			path: pathConf{SourceProtocol: "tcp", ReadTimeout: stringDuration(time.Second), SourceUser: "admin", SourcePass: "pass"},
+			want: pkg.RtspConfig{Transport: "tcp", ReadTimeout: time.Second, ReadBufferCount: 256, Username: "admin", Password: "pass"},
+		},
+		{
+			name: "password file",
+			path: pathConf{SourceUser: "admin", SourcePass: "ignored", SourcePassFile: passFile},
+			want: pkg.RtspConfig{Transport: pkg.RtspTransportAuto, ReadTimeout: 10 * time.Second, ReadBufferCount: 256, Username: "admin", Password: "secret"},
+		},
+		{
+			name:    "missing password file",
+			path:    pathConf{SourcePassFile: passFile + ".missing"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.path.rtspConfig(defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rtspConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("rtspConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(conf *serverConfig)
+		wantErr bool
+	}{
+		{"defaults", func(conf *serverConfig) {}, false},
+		{"nat host", func(conf *serverConfig) { conf.NAT1To1IPs = []string{"203.0.113.1"} }, false},
+		{"invalid candidate type", func(conf *serverConfig) {
+			conf.NAT1To1IPs = []string{"203.0.113.1"}
+			conf.NAT1To1CandidateType = "relay"
+		}, true},
+		{"srflx candidate type", func(conf *serverConfig) {
+			conf.NAT1To1IPs = []string{"203.0.113.1"}
+			conf.NAT1To1CandidateType = "srflx"
+		}, true},
+		{"path with missing password file", func(conf *serverConfig) {
+			conf.Paths = map[string]pathConf{"cam1": {Source: "rtsp://host/a", SourcePassFile: filepath.Join(t.TempDir(), "missing")}}
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := defaultConfig()
+			tt.modify(conf)
+			if _, err := conf.engineOptions(); (err != nil) != tt.wantErr {
+				t.Errorf("engineOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
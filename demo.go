@@ -2,46 +2,56 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/aler9/gortsplib/pkg/rtpcleaner"
 	"github.com/aler9/gortsplib/pkg/rtpreorderer"
 	"github.com/general252/rtsp_to_webrtc/pkg"
 	"github.com/gookit/color"
-	"github.com/pion/interceptor"
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
+	"io"
 	"log"
-	"net"
 	"os"
 	"time"
 )
 
 var (
-	pcA *webrtc.PeerConnection
-	pcB *webrtc.PeerConnection
-
-	config = webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
+	// 本机两个PeerConnection互连, 不需要STUN
+	config = webrtc.Configuration{}
 
 	chOffer  = make(chan webrtc.SessionDescription, 1)
 	chAnswer = make(chan *webrtc.SessionDescription, 1)
 
 	stringA = color.FgRed.Sprint
 	stringB = color.FgGreen.Sprint
+
+	// demo 命令的端口
+	demoOfferPort  = 2001
+	demoAnswerPort = 2002
+	demoRTPPort    = 5006
+	demoRTPStream  = "rtp"
 )
 
-func offer() error {
-	var err error
-	if pcA, err = CreateWebrtcAPI(2001).NewPeerConnection(config); err != nil {
+// offer 请求视频, ctx结束后断开PeerConnection并释放端口
+func offer(ctx context.Context) error {
+	api, closer, err := CreateWebrtcAPI(demoOfferPort)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer func() {
+		_ = closer.Close()
+	}()
+
+	pc, err := api.NewPeerConnection(config)
+	if err != nil {
 		log.Println(stringA(err))
 		return err
 	}
-	pc := pcA
+	defer func() {
+		_ = pc.Close()
+	}()
 
 	// Set the handler for ICE connection state
 	// This will notify you when the peer has connected/disconnected
@@ -61,11 +71,21 @@ func offer() error {
 	})
 
 	pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		// track结束后停止PLI
+		done := make(chan struct{})
+		defer close(done)
+
 		go func() {
 			ticker := time.NewTicker(time.Second * 2)
-			for range ticker.C {
-				if rtcpErr := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}}); rtcpErr != nil {
-					fmt.Println(stringA(rtcpErr))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if rtcpErr := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}}); rtcpErr != nil {
+						log.Println(stringA(rtcpErr))
+					}
 				}
 			}
 		}()
@@ -75,7 +95,15 @@ func offer() error {
 		reorder := rtpreorderer.New()
 		cleaner := rtpcleaner.New(true, false)
 
-		fp, _ := os.Create("out2.h264")
+		fp, err := os.Create("out2.h264")
+		if err != nil {
+			log.Println(stringA(err))
+			return
+		}
+		defer func() {
+			_ = fp.Close()
+		}()
+
 		var (
 			annexBNALUStartCode = []byte{0x00, 0x00, 0x00, 0x01}
 			packetBuffer        bytes.Buffer
@@ -132,21 +160,54 @@ func offer() error {
 
 	log.Println(stringA("[A] wait answer"))
 	// 等answer
-	answerSDP := <-chAnswer
+	var answerSDP *webrtc.SessionDescription
+	select {
+	case answerSDP = <-chAnswer:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
 	log.Println(stringA("[A] get answer"))
 	_ = pc.SetRemoteDescription(*answerSDP)
 
+	<-ctx.Done()
 	return nil
 }
 
-func answer() error {
-	var err error
-	if pcB, err = CreateWebrtcAPI(2002).NewPeerConnection(config); err != nil {
+// answer 发送rtp输入的视频, ctx结束后断开PeerConnection并释放端口
+func answer(ctx context.Context) error {
+	// rtp端口收到的H264注册为流 demoRTPStream
+	engine, err := pkg.NewWebRtcEngine(
+		pkg.WithListenAddress(fmt.Sprintf(":%d", demoAnswerPort)),
+		pkg.WithRTPInputs(pkg.RTPInput{Name: demoRTPStream, Address: fmt.Sprintf("127.0.0.1:%d", demoRTPPort)}),
+	)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer func() {
+		_ = engine.Close()
+	}()
+
+	stream, err := engine.Streams().Get(demoRTPStream)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	subscriber, err := stream.Subscribe()
+	if err != nil {
 		log.Println(err)
 		return err
 	}
-	pc := pcB
+
+	pc, err := engine.API().NewPeerConnection(config)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer func() {
+		_ = pc.Close()
+	}()
 
 	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		log.Printf(stringB("[B] [ice state] Connection State has changed ", connectionState.String()))
@@ -164,10 +225,8 @@ func answer() error {
 		}
 	})
 
-	// Create a video track
-	videoTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
-		"pion-rtsp-video-sample", "pion-rtsp-video-stream-sample",
-	)
+	// 订阅rtp输入的video track
+	videoTrack := subscriber.Tracks[0]
 
 	{
 		rtpSender, err := pc.AddTrack(videoTrack)
@@ -190,7 +249,12 @@ func answer() error {
 	}
 
 	log.Println(stringB("[B] wait offer"))
-	offerSDP := <-chOffer
+	var offerSDP webrtc.SessionDescription
+	select {
+	case offerSDP = <-chOffer:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
 	if err = pc.SetRemoteDescription(offerSDP); err != nil {
 		log.Println(err)
@@ -217,131 +281,16 @@ func answer() error {
 	chAnswer <- pc.LocalDescription()
 
 	//go pkg.RtspConsumerSample(pkg.RtspURL, pc, videoTrack)
-	go pkg.Rtp(5006, pc, videoTrack)
 
+	<-ctx.Done()
 	return nil
 }
 
-func CreateWebrtcAPI(muxUdpPort int) *webrtc.API {
-	// Listen on UDP Port 2000, will be used for all WebRTC traffic
-	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: muxUdpPort,
-	})
+// CreateWebrtcAPI 创建监听muxUdpPort的webrtc.API, 配置与WebRtcEngine相同; 不再使用时调用Close释放端口
+func CreateWebrtcAPI(muxUdpPort int) (*webrtc.API, io.Closer, error) {
+	engine, err := pkg.NewWebRtcEngine(pkg.WithListenAddress(fmt.Sprintf(":%d", muxUdpPort)))
 	if err != nil {
-		panic(err)
-	}
-
-	_ = udpListener.SetWriteBuffer(512 * 1024)
-	_ = udpListener.SetReadBuffer(512 * 1024)
-
-	log.Printf("Listening for WebRTC traffic at %s\n", udpListener.LocalAddr())
-
-	var options []func(*webrtc.API)
-
-	{
-		// Create a SettingEngine, this allows non-standard WebRTC behavior
-		settingEngine := webrtc.SettingEngine{}
-
-		// Configure our SettingEngine to use our UDPMux. By default a PeerConnection has
-		// no global state. The API+SettingEngine allows the user to share state between them.
-		// In this case we are sharing our listening port across many.
-		settingEngine.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpListener))
-
-		options = append(options, webrtc.WithSettingEngine(settingEngine))
+		return nil, nil, err
 	}
-
-	// Create a MediaEngine object to configure the supported codec
-	m := &webrtc.MediaEngine{}
-	{
-		var codecParams = []webrtc.RTPCodecParameters{
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, RTCPFeedback: nil},
-				PayloadType:        96,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0", RTCPFeedback: nil},
-				PayloadType:        98,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=1", RTCPFeedback: nil},
-				PayloadType:        100,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", RTCPFeedback: nil},
-				PayloadType:        125,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f", RTCPFeedback: nil},
-				PayloadType:        108,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032", RTCPFeedback: nil},
-				PayloadType:        123,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, RTCPFeedback: nil},
-				PayloadType:        35,
-			},
-		}
-
-		if false {
-			err = m.RegisterCodec(
-				webrtc.RTPCodecParameters{
-					RTPCodecCapability: webrtc.RTPCodecCapability{
-						MimeType:     webrtc.MimeTypeH264,
-						ClockRate:    90000,
-						Channels:     0,
-						SDPFmtpLine:  "",
-						RTCPFeedback: nil,
-					},
-					PayloadType: 96,
-				},
-				webrtc.RTPCodecTypeVideo,
-			)
-			if err != nil {
-				panic(err)
-			}
-		} else {
-			for _, param := range codecParams {
-				err = m.RegisterCodec(param, webrtc.RTPCodecTypeVideo)
-				if err != nil {
-					panic(err)
-				}
-			}
-		}
-
-		err = m.RegisterCodec(
-			webrtc.RTPCodecParameters{
-				RTPCodecCapability: webrtc.RTPCodecCapability{
-					MimeType:     webrtc.MimeTypeOpus,
-					ClockRate:    48000,
-					Channels:     0,
-					SDPFmtpLine:  "",
-					RTCPFeedback: nil,
-				},
-				PayloadType: 111,
-			},
-			webrtc.RTPCodecTypeAudio,
-		)
-		if err != nil {
-			panic(err)
-		}
-	}
-
-	// Create a InterceptorRegistry. This is the user configurable RTP/RTCP Pipeline.
-	// This provides NACKs, RTCP Reports and other features. If you use `webrtc.NewPeerConnection`
-	// this is enabled by default. If you are manually managing You MUST create a InterceptorRegistry
-	// for each PeerConnection.
-	i := &interceptor.Registry{}
-
-	// Use the default set of Interceptors
-	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
-		panic(err)
-	}
-
-	options = append(options, webrtc.WithMediaEngine(m))
-	options = append(options, webrtc.WithInterceptorRegistry(i))
-
-	return webrtc.NewAPI(options...)
+	return engine.API(), engine, nil
 }
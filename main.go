@@ -1,23 +1,85 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/general252/rtsp_to_webrtc/pkg"
 	"github.com/gin-gonic/gin"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 //go:embed static/*
 var fileContent embed.FS
 
-func mainX() {
-	log.SetFlags(log.Lshortfile | log.LstdFlags)
+const usage = `usage: rtsp_to_webrtc <command> [flags]
 
-	// Create a new API using our SettingEngine
-	engine := pkg.NewWebRtcEngine(2000)
-	_ = engine
+commands:
+  serve   启动http及webrtc服务 (默认)
+  demo    本机两个PeerConnection互连, 播放rtp端口收到的H264
+  probe   DESCRIBE rtsp地址, 显示track及对应的webrtc编码
+
+rtsp_to_webrtc <command> -h 查看参数
+`
+
+// serve 启动服务, 命令行参数覆盖配置文件, ctx结束后在shutdownTimeout内退出
+func serve(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "配置文件")
+	httpAddress := fs.String("http", "", "http监听地址, 如 :8080")
+	webrtcAddress := fs.String("webrtc", "", "webrtc UDP监听地址, 如 :2000")
+	webrtcTCPPort := fs.Int("webrtc-tcp-port", 0, "webrtc ICE-TCP端口, 0不启用")
+	rtspServer := fs.String("rtsp-server", "", "流路径对应的rtsp服务器, 如 rtsp://127.0.0.1:8554")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 0, "退出时等待连接断开的最长时间, 如 10s")
+	_ = fs.Parse(args)
+
+	// 明确指定的配置文件必须存在
+	required := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			required = true
+		}
+	})
+
+	conf, err := loadConfig(*configPath, required)
+	if err != nil {
+		return err
+	}
 
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "http":
+			conf.HTTPAddress = *httpAddress
+		case "webrtc":
+			conf.WebrtcAddress = *webrtcAddress
+		case "webrtc-tcp-port":
+			conf.WebrtcTCPPort = *webrtcTCPPort
+		case "rtsp-server":
+			conf.RtspServer = *rtspServer
+		case "shutdown-timeout":
+			conf.ShutdownTimeout = stringDuration(*shutdownTimeout)
+		}
+	})
+
+	opts, err := conf.engineOptions()
+	if err != nil {
+		return err
+	}
+
+	// Create a new API using our SettingEngine
+	engine, err := pkg.NewWebRtcEngine(opts...)
+	if err != nil {
+		return err
+	}
 	r := gin.Default()
 
 	// 从定向
@@ -28,28 +90,173 @@ func mainX() {
 	r.GET("/static/*filepath", func(c *gin.Context) {
 		http.FileServer(http.FS(fileContent)).ServeHTTP(c.Writer, c.Request)
 	})
-	r.POST("/RtspToWebrtc", engine.RtspToWebrtc)
-	r.POST("/WebrtcToRtsp", engine.WebrtcToRtsp)
-	r.POST("/GetWebrtc", engine.GetWebrtc)
 
-	log.Println("Open http://127.0.0.1:8080 to access this demo")
-	if err := r.Run(":8080"); err != nil {
-		log.Println(err)
+	// 接口需要认证, 页面不需要
+	api := r.Group("/")
+	if conf.AuthUser != "" {
+		api.Use(basicAuth(conf.AuthUser, conf.AuthPass))
 	}
+
+	api.POST("/RtspToWebrtc", engine.RtspToWebrtc)
+	api.POST("/WebrtcToRtsp", engine.WebrtcToRtsp)
+	api.POST("/GetWebrtc", engine.GetWebrtc)
+
+	// 浏览器使用的ICE服务器
+	api.GET("/iceServers", engine.ICEServers)
+
+	// websocket信令, trickle ice
+	api.GET("/signaling", engine.Signaling)
+
+	// 会话管理
+	api.GET("/sessions", engine.SessionList)
+	api.GET("/sessions/:id", engine.SessionGet)
+	api.DELETE("/sessions/:id", engine.SessionDelete)
+
+	// WHEP
+	api.OPTIONS("/whep", engine.WhepOptions)
+	api.POST("/whep", engine.WhepOffer)
+	api.OPTIONS("/whep/:id", engine.WhepOptions)
+	api.PATCH("/whep/:id", engine.WhepPatch)
+	api.DELETE("/whep/:id", engine.WhepDelete)
+
+	// WHIP
+	api.OPTIONS("/whip", engine.WhipOptions)
+	api.POST("/whip", engine.WhipOffer)
+	api.OPTIONS("/whip/:id", engine.WhipOptions)
+	api.PATCH("/whip/:id", engine.WhipPatch)
+	api.DELETE("/whip/:id", engine.WhipDelete)
+
+	server := &http.Server{
+		Addr:    conf.HTTPAddress,
+		Handler: r,
+	}
+
+	// 收到退出信号后停止接受请求, 断开所有PeerConnection和rtsp连接
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		log.Println("shutting down")
+
+		// 每个阶段单独的期限: http请求最多等待一半时间, 之后到总期限为止断开会话和rtsp连接
+		timeout := time.Duration(conf.ShutdownTimeout)
+		deadline := time.Now().Add(timeout)
+
+		httpCtx, cancel := context.WithTimeout(context.Background(), timeout/2)
+		err := server.Shutdown(httpCtx)
+		cancel()
+
+		engineCtx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if engineErr := engine.Shutdown(engineCtx); err == nil {
+			err = engineErr
+		}
+		shutdown <- err
+	}()
+
+	log.Printf("Open http://%s to access this demo", conf.HTTPAddress)
+	if err = server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		_ = engine.Close()
+		return err
+	}
+
+	return <-shutdown
 }
 
-func main() {
-	go mainX()
+// basicAuth http基本认证; 浏览器的CORS预检请求 (OPTIONS) 不带认证信息, 不认证
+func basicAuth(user string, pass string) gin.HandlerFunc {
+	auth := gin.BasicAuth(gin.Accounts{user: pass})
 
-	log.SetFlags(log.Lshortfile | log.LstdFlags)
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		auth(c)
+	}
+}
 
+// demo 本机两个PeerConnection互连, ctx结束后断开
+func demo(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("demo", flag.ExitOnError)
+	fs.IntVar(&demoOfferPort, "offer-port", demoOfferPort, "offer端 webrtc UDP端口")
+	fs.IntVar(&demoAnswerPort, "answer-port", demoAnswerPort, "answer端 webrtc UDP端口")
+	fs.IntVar(&demoRTPPort, "rtp-port", demoRTPPort, "接收H264 rtp的UDP端口")
+	_ = fs.Parse(args)
+
+	// ctx结束后各自断开PeerConnection, 等待端口释放
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
-		_ = offer()
+		defer wg.Done()
+		_ = offer(ctx)
 	}()
 
 	go func() {
-		_ = answer()
+		defer wg.Done()
+		_ = answer(ctx)
 	}()
 
-	select {}
+	wg.Wait()
+	return nil
+}
+
+// probe 显示rtsp地址的track
+func probe(args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	transport := fs.String("transport", pkg.RtspTransportAuto, "rtsp传输方式: automatic, udp, multicast, tcp")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintln(fs.Output(), "usage: rtsp_to_webrtc probe [-transport tcp] rtsp://host:port/path")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	tracks, err := pkg.Probe(fs.Arg(0), pkg.RtspConfig{Transport: *transport})
+	if err != nil {
+		return err
+	}
+
+	for i, track := range tracks {
+		codec := track.Codec
+		if codec == "" {
+			codec = "(not supported)"
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t-> %s\n", i, track.Media, track.Control, track.Name, codec)
+	}
+	return nil
+}
+
+func main() {
+	log.SetFlags(log.Lshortfile | log.LstdFlags)
+
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	// SIGINT/SIGTERM 退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch command {
+	case "serve":
+		err = serve(ctx, args)
+	case "demo":
+		err = demo(ctx, args)
+	case "probe":
+		err = probe(args)
+	default:
+		_, _ = fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Println(err)
+		stop()
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBasicAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.GET("/static/*filepath", func(c *gin.Context) { c.Status(http.StatusOK) })
+	api := r.Group("/")
+	api.Use(basicAuth("admin", "pass"))
+	api.OPTIONS("/whep", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	api.POST("/whep", func(c *gin.Context) { c.Status(http.StatusCreated) })
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		user   string
+		pass   string
+		status int
+	}{
+		{"static page", http.MethodGet, "/static/index.html", "", "", http.StatusOK},
+		{"preflight", http.MethodOptions, "/whep", "", "", http.StatusNoContent},
+		{"api without auth", http.MethodPost, "/whep", "", "", http.StatusUnauthorized},
+		{"api wrong password", http.MethodPost, "/whep", "admin", "wrong", http.StatusUnauthorized},
+		{"api", http.MethodPost, "/whep", "admin", "pass", http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package pkg
 
 import (
+	"context"
+	"errors"
 	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v3"
 	"log"
@@ -8,38 +10,298 @@ import (
 )
 
 const (
+	// RtspServer The RTSP server that stream paths are resolved against
+	RtspServer = "rtsp://127.0.0.1:8554"
 	// RtspURL The RTSP URL that will be streamed
-	RtspURL  = "rtsp://127.0.0.1:8554/live"
+	RtspURL = RtspServer + "/live"
+	// MimeType 固定的视频编码
+	//
+	// Deprecated: 编码由rtsp DESCRIBE与浏览器offer协商, 见 Stream.Codecs
 	MimeType = webrtc.MimeTypeH264
+
+	// DefaultListenAddress WebRTC UDP mux 默认监听地址
+	DefaultListenAddress = ":2000"
+	// DefaultSocketBuffer UDP mux 默认收发缓冲区大小
+	DefaultSocketBuffer = 512 * 1024
 )
 
+// Option 配置WebRtcEngine
+type Option func(*WebRtcEngine)
+
 type WebRtcEngine struct {
 	api *webrtc.API
 
-	localRTPTrack *webrtc.TrackLocalStaticRTP
+	streams  *StreamRegistry
+	sources  *SourceManager
+	sessions *SessionManager
+
+	rtspServer     string
+	paths          map[string]string // 流名称 -> rtsp地址
+	allowedSources []string
+	allowedOrigins []string
+	iceServers     []ICEServer
+
+	turnConfig *TURNConfig
+	turn       *turnServer
+
+	iceTCPPort int
+	nat        natConfig
+
+	rtpInputs []RTPInput
+	inputs    []*rtpInput
+
+	rtspListen   *RtspListenConfig
+	rtspListener *rtspListener
+
+	listenAddress string
+	readBuffer    int
+	writeBuffer   int
+	videoCodecs   []webrtc.RTPCodecParameters
+	audioCodecs   []webrtc.RTPCodecParameters
+	interceptors  func(*webrtc.MediaEngine, *interceptor.Registry) error
+	settings      []func(*webrtc.SettingEngine)
+
+	udpListener *net.UDPConn
+	tcpListener *net.TCPListener
+}
+
+// NewWebRtcEngine 监听WebRTC端口并创建引擎, 不再使用时调用Close
+func NewWebRtcEngine(opts ...Option) (*WebRtcEngine, error) {
+	c := &WebRtcEngine{
+		streams:  NewStreamRegistry(),
+		sources:  NewSourceManager(),
+		sessions: NewSessionManager(),
+
+		listenAddress: DefaultListenAddress,
+		readBuffer:    DefaultSocketBuffer,
+		writeBuffer:   DefaultSocketBuffer,
+		videoCodecs:   defaultVideoCodecs,
+		audioCodecs:   defaultAudioCodecs,
+		interceptors:  webrtc.RegisterDefaultInterceptors,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if err := c.sources.validate(); err != nil {
+		return nil, err
+	}
+
+	options, err := c.getMuxOptions()
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	c.api = webrtc.NewAPI(options...)
+
+	if c.turnConfig != nil {
+		peers, err := c.turnPeers()
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		if c.turn, err = startTURNServer(*c.turnConfig, peers); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+
+	if c.rtspListen != nil {
+		if c.rtspListener, err = startRtspListener(c.streams, c.sources, c.remotePaths(), c.allowPublish, *c.rtspListen); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+
+	for _, input := range c.rtpInputs {
+		in, err := startRTPInput(c.streams, input)
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		c.inputs = append(c.inputs, in)
+	}
+
+	return c, nil
 }
 
-func NewWebRtcEngine(muxUdpPort int) *WebRtcEngine {
-	c := &WebRtcEngine{}
-	c.api = webrtc.NewAPI(c.getMuxOptions(muxUdpPort)...)
+// API 引擎的webrtc.API, 共用监听端口和编码配置
+func (tis *WebRtcEngine) API() *webrtc.API {
+	return tis.api
+}
 
-	return c
+// Streams 推流及RTP输入的流注册表
+func (tis *WebRtcEngine) Streams() *StreamRegistry {
+	return tis.streams
 }
 
-func (tis *WebRtcEngine) getMuxOptions(muxUdpPort int) []func(*webrtc.API) {
-	// Listen on UDP Port 2000, will be used for all WebRTC traffic
-	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: muxUdpPort,
-	})
+// Sources rtsp拉流管理, 使用引擎的rtsp参数
+func (tis *WebRtcEngine) Sources() *SourceManager {
+	return tis.sources
+}
+
+// Shutdown 断开所有会话和rtsp连接, 等待会话结束或ctx超时, 然后释放端口
+func (tis *WebRtcEngine) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tis.sessions.Close()
+		tis.sources.Close()
+		tis.sessions.Wait()
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if closeErr := tis.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close 关闭监听端口
+func (tis *WebRtcEngine) Close() error {
+	var errs []error
+	if tis.udpListener != nil {
+		errs = append(errs, tis.udpListener.Close())
+	}
+	if tis.tcpListener != nil {
+		errs = append(errs, tis.tcpListener.Close())
+	}
+	if tis.turn != nil {
+		errs = append(errs, tis.turn.close())
+	}
+	for _, input := range tis.inputs {
+		errs = append(errs, input.close())
+	}
+	if tis.rtspListener != nil {
+		errs = append(errs, tis.rtspListener.close())
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithListenAddress WebRTC UDP mux 监听地址, 默认 DefaultListenAddress
+func WithListenAddress(address string) Option {
+	return func(tis *WebRtcEngine) {
+		tis.listenAddress = address
+	}
+}
+
+// WithSocketBuffer UDP mux 收发缓冲区大小
+func WithSocketBuffer(readBuffer int, writeBuffer int) Option {
+	return func(tis *WebRtcEngine) {
+		tis.readBuffer, tis.writeBuffer = readBuffer, writeBuffer
+	}
+}
+
+// WithCodecs 替换codecType类型的编码列表
+func WithCodecs(codecType webrtc.RTPCodecType, codecs ...webrtc.RTPCodecParameters) Option {
+	return func(tis *WebRtcEngine) {
+		switch codecType {
+		case webrtc.RTPCodecTypeVideo:
+			tis.videoCodecs = codecs
+		case webrtc.RTPCodecTypeAudio:
+			tis.audioCodecs = codecs
+		}
+	}
+}
+
+// WithInterceptors 替换默认的interceptor (NACK, RTCP Reports等)
+func WithInterceptors(register func(*webrtc.MediaEngine, *interceptor.Registry) error) Option {
+	return func(tis *WebRtcEngine) {
+		tis.interceptors = register
+	}
+}
+
+// WithSettingEngine 修改SettingEngine, 在引擎的设置之后调用
+func WithSettingEngine(setting func(*webrtc.SettingEngine)) Option {
+	return func(tis *WebRtcEngine) {
+		tis.settings = append(tis.settings, setting)
+	}
+}
+
+// WithICETCPPort 在port上监听ICE-TCP, 所有PeerConnection共用, 默认不启用
+func WithICETCPPort(port int) Option {
+	return func(tis *WebRtcEngine) {
+		tis.iceTCPPort = port
+	}
+}
+
+var defaultVideoCodecs = []webrtc.RTPCodecParameters{
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, RTCPFeedback: nil},
+		PayloadType:        96,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0", RTCPFeedback: nil},
+		PayloadType:        98,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=1", RTCPFeedback: nil},
+		PayloadType:        100,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", RTCPFeedback: nil},
+		PayloadType:        125,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f", RTCPFeedback: nil},
+		PayloadType:        108,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032", RTCPFeedback: nil},
+		PayloadType:        123,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, RTCPFeedback: nil},
+		PayloadType:        35,
+	},
+}
+
+var defaultAudioCodecs = []webrtc.RTPCodecParameters{
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil},
+		PayloadType:        111,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil},
+		PayloadType:        0,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil},
+		PayloadType:        8,
+	},
+}
+
+func (tis *WebRtcEngine) getMuxOptions() ([]func(*webrtc.API), error) {
+	if len(tis.videoCodecs) == 0 && len(tis.audioCodecs) == 0 {
+		return nil, errors.New("no codec configured")
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", tis.listenAddress)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	// Listen on UDP Port 2000, will be used for all WebRTC traffic
+	if tis.udpListener, err = net.ListenUDP("udp", udpAddr); err != nil {
+		return nil, err
 	}
 
-	_ = udpListener.SetWriteBuffer(512 * 1024)
-	_ = udpListener.SetReadBuffer(512 * 1024)
+	_ = tis.udpListener.SetWriteBuffer(tis.writeBuffer)
+	_ = tis.udpListener.SetReadBuffer(tis.readBuffer)
 
-	log.Printf("Listening for WebRTC traffic at %s\n", udpListener.LocalAddr())
+	log.Printf("Listening for WebRTC traffic at %s\n", tis.udpListener.LocalAddr())
 
 	var options []func(*webrtc.API)
 
@@ -50,86 +312,51 @@ func (tis *WebRtcEngine) getMuxOptions(muxUdpPort int) []func(*webrtc.API) {
 		// Configure our SettingEngine to use our UDPMux. By default a PeerConnection has
 		// no global state. The API+SettingEngine allows the user to share state between them.
 		// In this case we are sharing our listening port across many.
-		settingEngine.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpListener))
+		settingEngine.SetICEUDPMux(webrtc.NewICEUDPMux(nil, tis.udpListener))
 
-		options = append(options, webrtc.WithSettingEngine(settingEngine))
-	}
-
-	// Create a MediaEngine object to configure the supported codec
-	m := &webrtc.MediaEngine{}
-	{
-		var codecParams = []webrtc.RTPCodecParameters{
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, RTCPFeedback: nil},
-				PayloadType:        96,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0", RTCPFeedback: nil},
-				PayloadType:        98,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=1", RTCPFeedback: nil},
-				PayloadType:        100,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", RTCPFeedback: nil},
-				PayloadType:        125,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f", RTCPFeedback: nil},
-				PayloadType:        108,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032", RTCPFeedback: nil},
-				PayloadType:        123,
-			},
-			{
-				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, RTCPFeedback: nil},
-				PayloadType:        35,
-			},
+		// NAT 1:1 映射, 网卡过滤
+		if err = tis.nat.apply(&settingEngine); err != nil {
+			return nil, err
 		}
 
-		if false {
-			err = m.RegisterCodec(
-				webrtc.RTPCodecParameters{
-					RTPCodecCapability: webrtc.RTPCodecCapability{
-						MimeType:     webrtc.MimeTypeH264,
-						ClockRate:    90000,
-						Channels:     0,
-						SDPFmtpLine:  "",
-						RTCPFeedback: nil,
-					},
-					PayloadType: 96,
-				},
-				webrtc.RTPCodecTypeVideo,
-			)
+		// UDP不通时使用ICE-TCP
+		if tis.iceTCPPort > 0 {
+			tis.tcpListener, err = net.ListenTCP("tcp", &net.TCPAddr{
+				IP:   udpAddr.IP,
+				Port: tis.iceTCPPort,
+			})
 			if err != nil {
-				panic(err)
-			}
-		} else {
-			for _, param := range codecParams {
-				err = m.RegisterCodec(param, webrtc.RTPCodecTypeVideo)
-				if err != nil {
-					panic(err)
-				}
+				return nil, err
 			}
+
+			log.Printf("Listening for WebRTC ICE-TCP traffic at %s\n", tis.tcpListener.Addr())
+
+			settingEngine.SetICETCPMux(webrtc.NewICETCPMux(nil, tis.tcpListener, 8))
+			settingEngine.SetNetworkTypes([]webrtc.NetworkType{
+				webrtc.NetworkTypeUDP4,
+				webrtc.NetworkTypeUDP6,
+				webrtc.NetworkTypeTCP4,
+				webrtc.NetworkTypeTCP6,
+			})
 		}
 
-		err = m.RegisterCodec(
-			webrtc.RTPCodecParameters{
-				RTPCodecCapability: webrtc.RTPCodecCapability{
-					MimeType:     webrtc.MimeTypeOpus,
-					ClockRate:    48000,
-					Channels:     0,
-					SDPFmtpLine:  "",
-					RTCPFeedback: nil,
-				},
-				PayloadType: 111,
-			},
-			webrtc.RTPCodecTypeAudio,
-		)
-		if err != nil {
-			panic(err)
+		for _, setting := range tis.settings {
+			setting(&settingEngine)
+		}
+
+		options = append(options, webrtc.WithSettingEngine(settingEngine))
+	}
+
+	// Create a MediaEngine object to configure the supported codec
+	m := &webrtc.MediaEngine{}
+	for _, param := range tis.videoCodecs {
+		if err = m.RegisterCodec(param, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+	for _, param := range tis.audioCodecs {
+		if err = m.RegisterCodec(param, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
 		}
 	}
 
@@ -140,12 +367,14 @@ func (tis *WebRtcEngine) getMuxOptions(muxUdpPort int) []func(*webrtc.API) {
 	i := &interceptor.Registry{}
 
 	// Use the default set of Interceptors
-	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
-		panic(err)
+	if tis.interceptors != nil {
+		if err = tis.interceptors(m, i); err != nil {
+			return nil, err
+		}
 	}
 
 	options = append(options, webrtc.WithMediaEngine(m))
 	options = append(options, webrtc.WithInterceptorRegistry(i))
 
-	return options
+	return options, nil
 }
@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestWebRtcEngineShutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		hang    bool // 会话不结束
+		wantErr error
+	}{
+		{"sessions end", false, nil},
+		{"session does not end", true, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine, err := NewWebRtcEngine(WithListenAddress("127.0.0.1:0"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			address := engine.udpListener.LocalAddr().String()
+
+			stream, err := engine.streams.Publish("live")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc, err := engine.api.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := stream.Done()
+			if tt.hang {
+				done = make(chan struct{})
+			}
+			// 会话结束时移除流
+			pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+				if state == webrtc.PeerConnectionStateClosed {
+					stream.Close()
+				}
+			})
+			engine.sessions.add(SessionPlay, stream, pc, done)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			if err = engine.Shutdown(ctx); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Shutdown() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if state := pc.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+				t.Errorf("PeerConnection state = %v, want closed", state)
+			}
+
+			// 端口已释放
+			udpAddr, err := net.ResolveUDPAddr("udp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := net.ListenUDP("udp", udpAddr)
+			if err != nil {
+				t.Fatalf("port is not released: %v", err)
+			}
+			_ = conn.Close()
+		})
+	}
+}
+
+func TestICETCPPort(t *testing.T) {
+	inUse, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = inUse.Close() }()
+	_, free, _ := net.SplitHostPort(freeAddress(t))
+	_, busy, _ := net.SplitHostPort(inUse.Addr().String())
+
+	tests := []struct {
+		name    string
+		port    string
+		wantErr bool
+	}{
+		{"listen", free, false},
+		{"port in use", busy, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port, _ := strconv.Atoi(tt.port)
+			engine, err := NewWebRtcEngine(WithListenAddress("127.0.0.1:0"), WithICETCPPort(port))
+			if tt.wantErr {
+				if err == nil {
+					_ = engine.Close()
+					t.Fatal("NewWebRtcEngine() with the ICE-TCP port in use should fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = engine.Close() }()
+
+			// PeerConnection收集ICE-TCP候选地址, 使用共用的端口
+			pc, err := engine.api.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = pc.Close() }()
+			if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+				t.Fatal(err)
+			}
+			offer, err := pc.CreateOffer(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gatherComplete := webrtc.GatheringCompletePromise(pc)
+			if err = pc.SetLocalDescription(offer); err != nil {
+				t.Fatal(err)
+			}
+			<-gatherComplete
+
+			found := false
+			for _, line := range strings.Split(pc.LocalDescription().SDP, "\r\n") {
+				if strings.HasPrefix(line, "a=candidate:") && strings.Contains(line, " tcp ") {
+					found = strings.Contains(line, " "+tt.port+" typ host tcptype passive")
+				}
+			}
+			if !found {
+				t.Errorf("no passive tcp candidate on port %s:\n%s", tt.port, pc.LocalDescription().SDP)
+			}
+
+			// ICE-TCP端口可以连接
+			conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", tt.port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.Close()
+		})
+	}
+}
+
+func TestNewWebRtcEngineErrors(t *testing.T) {
+	udpInUse, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = udpInUse.Close() }()
+	tcpInUse, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tcpInUse.Close() }()
+
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"invalid address", []Option{WithListenAddress("127.0.0.1:port")}},
+		{"udp port in use", []Option{WithListenAddress(udpInUse.LocalAddr().String())}},
+		{"no codec", []Option{WithCodecs(webrtc.RTPCodecTypeVideo), WithCodecs(webrtc.RTPCodecTypeAudio)}},
+		{"interceptors", []Option{WithInterceptors(func(*webrtc.MediaEngine, *interceptor.Registry) error {
+			return errors.New("register interceptors")
+		})}},
+		{"rtsp port in use", []Option{WithRtspListen(RtspListenConfig{Address: tcpInUse.Addr().String()})}},
+		{"rtp input port in use", []Option{WithRTPInputs(RTPInput{Name: "rtp", Address: udpInUse.LocalAddr().String()})}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 固定的空闲端口, 检查失败后WebRTC端口被释放
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			address := conn.LocalAddr().String()
+			_ = conn.Close()
+
+			// 返回错误而不是panic
+			engine, err := NewWebRtcEngine(append([]Option{WithListenAddress(address)}, tt.opts...)...)
+			if err == nil {
+				_ = engine.Close()
+				t.Fatal("NewWebRtcEngine() should fail")
+			}
+			if engine != nil {
+				t.Errorf("NewWebRtcEngine() = %v, want nil on error", engine)
+			}
+
+			udpAddr, err := net.ResolveUDPAddr("udp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conn, err = net.ListenUDP("udp", udpAddr); err != nil {
+				t.Fatalf("port is not released: %v", err)
+			}
+			_ = conn.Close()
+		})
+	}
+}
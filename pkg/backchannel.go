@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aler9/gortsplib/pkg/base"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// ONVIF backchannel 双向语音
+// 浏览器麦克风的音频通过同一个PeerConnection发送, 转发到摄像头的backchannel track
+
+const onvifBackchannel = "www.onvif.org/ver20/backchannel"
+
+var (
+	// ErrNoBackchannel 摄像头没有可用的backchannel track
+	ErrNoBackchannel = errors.New("no backchannel track")
+	// ErrBackchannelBusy backchannel已被其它观看者占用
+	ErrBackchannelBusy = errors.New("backchannel is busy")
+)
+
+// requireBackchannel DESCRIBE/SETUP/PLAY 需要带 Require 头
+func requireBackchannel(req *base.Request) {
+	switch req.Method {
+	case base.Describe, base.Setup, base.Play:
+		req.Header["Require"] = base.HeaderValue{onvifBackchannel}
+	}
+}
+
+// sendonlyControls SDP中 a=sendonly 的媒体的 control 属性
+func sendonlyControls(sdp string) map[string]bool {
+	result := map[string]bool{}
+
+	var (
+		control  string
+		sendonly bool
+	)
+	flush := func() {
+		if sendonly {
+			result[control] = true
+		}
+		control, sendonly = "", false
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(sdp))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "m="):
+			flush()
+		case strings.HasPrefix(line, "a=control:"):
+			control = strings.TrimPrefix(line, "a=control:")
+		case line == "a=sendonly":
+			sendonly = true
+		}
+	}
+	flush()
+
+	return result
+}
+
+// SubscribeBackchannel 订阅rtsp地址并占用摄像头的backchannel, 取消订阅后释放
+func (tis *SourceManager) SubscribeBackchannel(ctx context.Context, address string) (*Subscriber, *Backchannel, error) {
+	sub, src, err := tis.subscribe(ctx, address, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !atomic.CompareAndSwapInt32(&src.talking, 0, 1) {
+		sub.Close()
+		return nil, nil, fmt.Errorf("%w: %s", ErrBackchannelBusy, sub.Stream().Name())
+	}
+
+	codec, _ := codecFromTrack(src.backchannelTrack)
+	payloadType, _ := strconv.Atoi(src.backchannelTrack.MediaDescription().MediaName.Formats[0])
+
+	bc := &Backchannel{
+		src:         src,
+		Codec:       codec,
+		payloadType: uint8(payloadType),
+	}
+
+	go func() {
+		<-sub.Done()
+		bc.Close()
+	}()
+
+	return sub, bc, nil
+}
+
+// Backchannel 向摄像头发送音频
+type Backchannel struct {
+	src         *rtspSource
+	payloadType uint8
+	closeOnce   sync.Once
+
+	// Codec 摄像头backchannel的编码, 浏览器须使用相同编码
+	Codec webrtc.RTPCodecCapability
+}
+
+// WriteRTP 发送音频RTP到摄像头, rtsp重连期间丢弃
+func (tis *Backchannel) WriteRTP(pkt *rtp.Packet) error {
+	client, trackID := tis.src.playingClient()
+	if client == nil {
+		return nil
+	}
+
+	pkt.PayloadType = tis.payloadType
+	return client.WritePacketRTP(trackID, pkt, true)
+}
+
+// Close 释放backchannel
+func (tis *Backchannel) Close() {
+	tis.closeOnce.Do(func() {
+		atomic.StoreInt32(&tis.src.talking, 0)
+	})
+}
+
+// receiveBackchannel 接收浏览器的音频并转发到摄像头
+func receiveBackchannel(pc *webrtc.PeerConnection, backchannel *Backchannel) error {
+	// 没有发送音频时, 单独接收音频, 并要求浏览器使用backchannel的编码
+	hasAudio := false
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Kind() == webrtc.RTPCodecTypeAudio {
+			hasAudio = true
+		}
+	}
+	if !hasAudio {
+		transceiver, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		})
+		if err != nil {
+			return err
+		}
+		if err = transceiver.SetCodecPreferences([]webrtc.RTPCodecParameters{{RTPCodecCapability: backchannel.Codec}}); err != nil {
+			return err
+		}
+	}
+
+	pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if remoteTrack.Kind() != webrtc.RTPCodecTypeAudio {
+			return
+		}
+
+		if !strings.EqualFold(remoteTrack.Codec().MimeType, backchannel.Codec.MimeType) {
+			log.Printf("[backchannel] browser sends %v, camera needs %v", remoteTrack.Codec().MimeType, backchannel.Codec.MimeType)
+			return
+		}
+
+		log.Printf("[backchannel] talk %v", backchannel.Codec.MimeType)
+		for {
+			pkt, _, err := remoteTrack.ReadRTP()
+			if err != nil {
+				return
+			}
+
+			if err = backchannel.WriteRTP(pkt); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+	})
+
+	return nil
+}
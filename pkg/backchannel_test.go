@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib/pkg/base"
+)
+
+func TestSendonlyControls(t *testing.T) {
+	tests := []struct {
+		name string
+		sdp  string
+		want []string
+	}{
+		{
+			name: "backchannel",
+			sdp: "v=0\r\ns=-\r\n" +
+				"m=video 0 RTP/AVP 96\r\na=control:trackID=0\r\na=recvonly\r\n" +
+				"m=audio 0 RTP/AVP 0\r\na=control:trackID=1\r\na=recvonly\r\n" +
+				"m=audio 0 RTP/AVP 0\r\na=control:trackID=2\r\na=sendonly\r\n",
+			want: []string{"trackID=2"},
+		},
+		{
+			// a=sendonly 在 a=control 之前
+			name: "attribute order",
+			sdp: "v=0\r\ns=-\r\n" +
+				"m=audio 0 RTP/AVP 8\r\na=sendonly\r\na=control:rtsp://camera/back\r\n",
+			want: []string{"rtsp://camera/back"},
+		},
+		{
+			name: "none",
+			sdp:  "v=0\r\ns=-\r\nm=video 0 RTP/AVP 96\r\na=control:trackID=0\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sendonlyControls(tt.sdp)
+			if len(got) != len(tt.want) {
+				t.Fatalf("sendonlyControls() = %v, want %v", got, tt.want)
+			}
+			for _, control := range tt.want {
+				if !got[control] {
+					t.Errorf("sendonlyControls() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireBackchannel(t *testing.T) {
+	tests := []struct {
+		method base.Method
+		want   bool
+	}{
+		{base.Options, false},
+		{base.Describe, true},
+		{base.Setup, true},
+		{base.Play, true},
+		{base.Teardown, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.method), func(t *testing.T) {
+			req := &base.Request{Method: tt.method, Header: base.Header{}}
+			requireBackchannel(req)
+
+			require, ok := req.Header["Require"]
+			if ok != tt.want || (ok && (len(require) != 1 || require[0] != onvifBackchannel)) {
+				t.Errorf("Require = %v, want %v", require, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlayErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("%w: cam1", ErrNoBackchannel), http.StatusNotAcceptable},
+		{fmt.Errorf("%w: cam1", ErrBackchannelBusy), http.StatusConflict},
+		{fmt.Errorf("%w: H265", ErrNoCommonCodec), http.StatusNotAcceptable},
+		{errors.New("connection refused"), http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		if got := playErrorStatus(tt.err); got != tt.want {
+			t.Errorf("playErrorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSubscribeNoBackchannel(t *testing.T) {
+	upstream := NewStreamRegistry()
+	server := startTestRtspServer(t, upstream)
+	publishTestStream(t, upstream, "cam1")
+
+	manager := NewSourceManager()
+	defer manager.Close()
+
+	// 摄像头没有sendonly音频, 不重连, 立即返回
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := manager.SubscribeBackchannel(ctx, server+"/cam1"); !errors.Is(err, ErrNoBackchannel) {
+		t.Fatalf("SubscribeBackchannel() error = %v, want ErrNoBackchannel", err)
+	}
+
+	// 不影响普通观看
+	sub, err := manager.Subscribe(ctx, server+"/cam1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Close()
+}
@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/webrtc/v3"
+)
+
+// rtsp track 与 webrtc 编码的相互转换
+
+// ErrNoCommonCodec rtsp与webrtc两端没有共同支持的编码
+var ErrNoCommonCodec = errors.New("no common codec")
+
+// codecFromTrack rtsp track 转 webrtc 编码, 不支持的track返回false
+func codecFromTrack(track gortsplib.Track) (webrtc.RTPCodecCapability, bool) {
+	switch t := track.(type) {
+	case *gortsplib.TrackH264:
+		profileLevelID := "42e01f"
+		if sps := t.SafeSPS(); len(sps) >= 4 {
+			profileLevelID = fmt.Sprintf("%02x%02x%02x", sps[1], sps[2], sps[3])
+		}
+		return webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profileLevelID,
+		}, true
+
+	case *gortsplib.TrackVP8:
+		return webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeVP8,
+			ClockRate: 90000,
+		}, true
+
+	case *gortsplib.TrackVP9:
+		profileID := 0
+		if t.ProfileID != nil {
+			profileID = *t.ProfileID
+		}
+		return webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeVP9,
+			ClockRate:   90000,
+			SDPFmtpLine: "profile-id=" + strconv.Itoa(profileID),
+		}, true
+
+	case *gortsplib.TrackOpus:
+		return webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		}, true
+
+	case *gortsplib.TrackPCMU:
+		return webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypePCMU,
+			ClockRate: 8000,
+		}, true
+
+	case *gortsplib.TrackPCMA:
+		return webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypePCMA,
+			ClockRate: 8000,
+		}, true
+
+	case *gortsplib.TrackGeneric:
+		// gortsplib 没有AV1类型
+		if t.Media == "video" && strings.HasPrefix(strings.ToUpper(rtpmapEncoding(t.RTPMap)), "AV1/") {
+			return webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeAV1,
+				ClockRate:   90000,
+				SDPFmtpLine: t.FMTP,
+			}, true
+		}
+	}
+
+	return webrtc.RTPCodecCapability{}, false
+}
+
+// codecFromName 编码名称转 webrtc 编码, 如 H264, opus
+func codecFromName(name string) (webrtc.RTPCodecCapability, error) {
+	switch strings.ToLower(name) {
+	case "h264":
+		return webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+		}, nil
+	case "vp8":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, nil
+	case "vp9":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"}, nil
+	case "av1":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000}, nil
+	case "opus":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}, nil
+	case "pcmu":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, nil
+	case "pcma":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, nil
+	}
+
+	return webrtc.RTPCodecCapability{}, fmt.Errorf("%w: unknown codec '%s'", ErrNoCommonCodec, name)
+}
+
+// trackFromCodec webrtc 协商后的编码转 rtsp track
+func trackFromCodec(codec webrtc.RTPCodecParameters) (gortsplib.Track, error) {
+	pt := uint8(codec.PayloadType)
+
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return &gortsplib.TrackH264{PayloadType: pt}, nil
+
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return &gortsplib.TrackVP8{PayloadType: pt}, nil
+
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		track := &gortsplib.TrackVP9{PayloadType: pt}
+		if v, ok := fmtpValue(codec.SDPFmtpLine, "profile-id"); ok {
+			if profileID, err := strconv.Atoi(v); err == nil {
+				track.ProfileID = &profileID
+			}
+		}
+		return track, nil
+
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return &gortsplib.TrackGeneric{
+			Media:   "video",
+			Formats: []string{strconv.Itoa(int(pt))},
+			RTPMap:  fmt.Sprintf("%d AV1/90000", pt),
+			FMTP:    strings.TrimSpace(fmt.Sprintf("%d %s", pt, codec.SDPFmtpLine)),
+		}, nil
+
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return &gortsplib.TrackOpus{PayloadType: pt, SampleRate: 48000, ChannelCount: 2}, nil
+
+	case strings.ToLower(webrtc.MimeTypePCMU):
+		return &gortsplib.TrackPCMU{}, nil
+
+	case strings.ToLower(webrtc.MimeTypePCMA):
+		return &gortsplib.TrackPCMA{}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s is not supported by rtsp", ErrNoCommonCodec, codec.MimeType)
+}
+
+// trackName track 的描述, 用于日志
+func trackName(track gortsplib.Track) string {
+	if codec, ok := codecFromTrack(track); ok {
+		return codec.MimeType
+	}
+	md := track.MediaDescription()
+	if rtpmap, ok := md.Attribute("rtpmap"); ok {
+		return md.MediaName.Media + "/" + rtpmapEncoding(rtpmap)
+	}
+	return md.MediaName.Media + "/" + strings.Join(md.MediaName.Formats, ",")
+}
+
+// rtpmapEncoding "96 H264/90000" -> "H264/90000"
+func rtpmapEncoding(rtpmap string) string {
+	parts := strings.SplitN(strings.TrimSpace(rtpmap), " ", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// fmtpValue 获取 fmtp 参数
+func fmtpValue(fmtp string, key string) (string, bool) {
+	for _, kv := range strings.Split(fmtp, ";") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], key) {
+			return parts[1], true
+		}
+	}
+	return "", false
+}
+
+// sdpMimeTypes SDP中出现的所有编码, 如 video/h264
+func sdpMimeTypes(sdp string) map[string]bool {
+	result := map[string]bool{}
+
+	var media string
+	scanner := bufio.NewScanner(strings.NewReader(sdp))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "m="):
+			media = strings.SplitN(strings.TrimPrefix(line, "m="), " ", 2)[0]
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			encoding := rtpmapEncoding(strings.TrimPrefix(line, "a=rtpmap:"))
+			name := strings.SplitN(encoding, "/", 2)[0]
+			result[strings.ToLower(media+"/"+name)] = true
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,198 @@
+package pkg
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestCodecFromTrack(t *testing.T) {
+	profileID := 2
+
+	tests := []struct {
+		name  string
+		track gortsplib.Track
+		want  webrtc.RTPCodecCapability
+		ok    bool
+	}{
+		{
+			name:  "h264 without sps",
+			track: &gortsplib.TrackH264{PayloadType: 96},
+			want: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000,
+				SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+			ok: true,
+		},
+		{
+			name:  "h264 profile from sps",
+			track: &gortsplib.TrackH264{PayloadType: 96, SPS: []byte{0x67, 0x64, 0x00, 0x32, 0xac}},
+			want: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000,
+				SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032"},
+			ok: true,
+		},
+		{
+			name:  "vp8",
+			track: &gortsplib.TrackVP8{PayloadType: 96},
+			want:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			ok:    true,
+		},
+		{
+			name:  "vp9 profile",
+			track: &gortsplib.TrackVP9{PayloadType: 96, ProfileID: &profileID},
+			want:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=2"},
+			ok:    true,
+		},
+		{
+			name:  "opus",
+			track: &gortsplib.TrackOpus{PayloadType: 111, SampleRate: 48000, ChannelCount: 2},
+			want:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+			ok:    true,
+		},
+		{
+			name:  "pcmu",
+			track: &gortsplib.TrackPCMU{},
+			want:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+			ok:    true,
+		},
+		{
+			name:  "pcma",
+			track: &gortsplib.TrackPCMA{},
+			want:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000},
+			ok:    true,
+		},
+		{
+			name:  "av1",
+			track: &gortsplib.TrackGeneric{Media: "video", Formats: []string{"98"}, RTPMap: "98 AV1/90000", FMTP: "98 profile=0"},
+			want:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, SDPFmtpLine: "98 profile=0"},
+			ok:    true,
+		},
+		{
+			name:  "unsupported generic",
+			track: &gortsplib.TrackGeneric{Media: "video", Formats: []string{"96"}, RTPMap: "96 H265/90000"},
+		},
+		{
+			name:  "unsupported h265",
+			track: &gortsplib.TrackH265{PayloadType: 96},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := codecFromTrack(tt.track)
+			if ok != tt.ok {
+				t.Fatalf("codecFromTrack() ok = %v, want %v", ok, tt.ok)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("codecFromTrack() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackFromCodec(t *testing.T) {
+	tests := []struct {
+		name      string
+		codec     webrtc.RTPCodecParameters
+		wantCodec string // 转回 webrtc 编码后的 MimeType
+		wantErr   bool
+	}{
+		{"h264", webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, PayloadType: 125}, webrtc.MimeTypeH264, false},
+		{"vp8", webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, PayloadType: 96}, webrtc.MimeTypeVP8, false},
+		{"vp9", webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, SDPFmtpLine: "profile-id=1"}, PayloadType: 100}, webrtc.MimeTypeVP9, false},
+		{"av1", webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1}, PayloadType: 35}, webrtc.MimeTypeAV1, false},
+		{"opus", webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, PayloadType: 111}, webrtc.MimeTypeOpus, false},
+		{"pcmu", webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU}, PayloadType: 0}, webrtc.MimeTypePCMU, false},
+		{"pcma", webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA}, PayloadType: 8}, webrtc.MimeTypePCMA, false},
+		{"mime type is case insensitive", webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "VIDEO/h264"}, PayloadType: 96}, webrtc.MimeTypeH264, false},
+		{"unsupported", webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/G722"}, PayloadType: 9}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			track, err := trackFromCodec(tt.codec)
+			if tt.wantErr {
+				if !errors.Is(err, ErrNoCommonCodec) {
+					t.Errorf("trackFromCodec() error = %v, want ErrNoCommonCodec", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 转回 webrtc 编码
+			codec, ok := codecFromTrack(track)
+			if !ok || codec.MimeType != tt.wantCodec {
+				t.Errorf("codecFromTrack(trackFromCodec()) = %v, %v, want %v", codec.MimeType, ok, tt.wantCodec)
+			}
+		})
+	}
+
+	// VP9 profile-id 保留
+	track, err := trackFromCodec(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, SDPFmtpLine: "profile-id=1"}, PayloadType: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vp9 := track.(*gortsplib.TrackVP9); vp9.ProfileID == nil || *vp9.ProfileID != 1 || vp9.PayloadType != 100 {
+		t.Errorf("vp9 track = %+v", vp9)
+	}
+}
+
+func TestCodecFromName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"H264", webrtc.MimeTypeH264, false},
+		{"vp8", webrtc.MimeTypeVP8, false},
+		{"VP9", webrtc.MimeTypeVP9, false},
+		{"av1", webrtc.MimeTypeAV1, false},
+		{"Opus", webrtc.MimeTypeOpus, false},
+		{"pcmu", webrtc.MimeTypePCMU, false},
+		{"PCMA", webrtc.MimeTypePCMA, false},
+		{"h265", "", true},
+	}
+
+	for _, tt := range tests {
+		codec, err := codecFromName(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("codecFromName(%q) error = %v", tt.name, err)
+			continue
+		}
+		if codec.MimeType != tt.want {
+			t.Errorf("codecFromName(%q) = %q, want %q", tt.name, codec.MimeType, tt.want)
+		}
+	}
+}
+
+func TestSDPMimeTypes(t *testing.T) {
+	got := sdpMimeTypes(testOffer)
+	want := map[string]bool{"audio/opus": true, "video/vp8": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sdpMimeTypes() = %v, want %v", got, want)
+	}
+}
+
+func TestFmtpValue(t *testing.T) {
+	tests := []struct {
+		fmtp  string
+		key   string
+		want  string
+		found bool
+	}{
+		{"profile-id=1", "profile-id", "1", true},
+		{"level-asymmetry-allowed=1; packetization-mode=1;profile-level-id=42e01f", "Profile-Level-Id", "42e01f", true},
+		{"minptime=10", "useinbandfec", "", false},
+		{"", "profile-id", "", false},
+	}
+
+	for _, tt := range tests {
+		got, found := fmtpValue(tt.fmtp, tt.key)
+		if got != tt.want || found != tt.found {
+			t.Errorf("fmtpValue(%q, %q) = %q, %v, want %q, %v", tt.fmtp, tt.key, got, found, tt.want, tt.found)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"errors"
 	"log"
 	"net/http"
 
@@ -12,80 +13,40 @@ import (
 // webrtc_to_rtsp流负责推流, 本项目拉流播放
 
 func (tis *WebRtcEngine) GetWebrtc(c *gin.Context) {
-	if tis.localRTPTrack == nil {
-		c.Abort()
-		return
-	}
-
-	var recvOnlyOffer webrtc.SessionDescription
-	if err := c.ShouldBindJSON(&recvOnlyOffer); err != nil {
-		log.Println(err)
-		c.Abort()
-		return
-	}
-
-	peerConnection, err := tis.api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	})
+	stream, err := tis.streams.Get(streamName(c.Query("stream")))
 	if err != nil {
 		log.Println(err)
-		c.Abort()
+		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
-	rtpSender, err := peerConnection.AddTrack(tis.localRTPTrack)
-	if err != nil {
+	var recvOnlyOffer webrtc.SessionDescription
+	if err = c.ShouldBindJSON(&recvOnlyOffer); err != nil {
 		log.Println(err)
 		c.Abort()
 		return
 	}
 
-	// Read incoming RTCP packets
-	// Before these packets are returned they are processed by interceptors. For things
-	// like NACK this needs to be called.
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
-		}
-	}()
-
-	// Set the remote SessionDescription
-	if err = peerConnection.SetRemoteDescription(recvOnlyOffer); err != nil {
+	subscriber, err := stream.Subscribe()
+	if err != nil {
 		log.Println(err)
-		c.Abort()
+		c.AbortWithStatus(http.StatusServiceUnavailable)
 		return
 	}
 
-	// Create answer
-	answer, err := peerConnection.CreateAnswer(nil)
-	if err != nil {
+	// 断开后取消订阅; 推流者离开后断开
+	session, err := tis.newPlayerPeerConnection(recvOnlyOffer, subscriber, nil, nil)
+	if errors.Is(err, ErrNoCommonCodec) {
 		log.Println(err)
-		c.Abort()
+		c.AbortWithStatus(http.StatusNotAcceptable)
 		return
-	}
-
-	// Create channel that is blocked until ICE Gathering is complete
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-
-	// Sets the LocalDescription, and starts our UDP listeners
-	if err = peerConnection.SetLocalDescription(answer); err != nil {
+	} else if err != nil {
 		log.Println(err)
 		c.Abort()
 		return
 	}
 
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
-
 	// Get the LocalDescription and take it to base64 so we can paste in browser
-	c.JSON(http.StatusOK, peerConnection.LocalDescription())
+	c.Header(sessionIDHeader, session.ID)
+	c.JSON(http.StatusOK, session.pc.LocalDescription())
 }
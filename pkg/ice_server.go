@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v3"
+)
+
+// ICE服务器配置, 服务端与浏览器使用相同的服务器
+// GET /iceServers 返回浏览器使用的 RTCIceServer 列表
+
+// DefaultTURNCredentialTTL TURN REST API 临时密码的有效期
+const DefaultTURNCredentialTTL = 24 * time.Hour
+
+// ICEServer STUN/TURN服务器
+// Secret 不为空时按 TURN REST API (coturn static-auth-secret) 生成临时用户名密码, 忽略 Username/Credential
+type ICEServer struct {
+	URLs       []string
+	Username   string
+	Credential string
+	Secret     string
+	TTL        time.Duration
+}
+
+// WithICEServers 设置STUN/TURN服务器, 默认不使用
+func WithICEServers(servers ...ICEServer) Option {
+	return func(tis *WebRtcEngine) {
+		tis.iceServers = append(tis.iceServers, servers...)
+	}
+}
+
+// turnRESTCredential TURN REST API 临时用户名密码
+// username = 过期时间戳:user, credential = base64(hmac-sha1(secret, username))
+func turnRESTCredential(secret string, user string, ttl time.Duration) (string, string) {
+	if ttl <= 0 {
+		ttl = DefaultTURNCredentialTTL
+	}
+
+	username := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10) + ":" + user
+	return username, turnRESTPassword(secret, username)
+}
+
+// turnRESTPassword base64(hmac-sha1(secret, username))
+func turnRESTPassword(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// webrtcICEServers 生成ICE服务器列表, user 用于临时用户名
+func (tis *WebRtcEngine) webrtcICEServers(user string) []webrtc.ICEServer {
+	var result []webrtc.ICEServer
+	for _, server := range tis.iceServers {
+		s := webrtc.ICEServer{
+			URLs: server.URLs,
+		}
+		if server.Secret != "" {
+			username, credential := turnRESTCredential(server.Secret, user, server.TTL)
+			s.Username, s.Credential = username, credential
+		} else if server.Username != "" {
+			s.Username, s.Credential = server.Username, server.Credential
+		}
+		if s.Username != "" {
+			s.CredentialType = webrtc.ICECredentialTypePassword
+		}
+
+		result = append(result, s)
+	}
+	return result
+}
+
+// configuration PeerConnection配置
+func (tis *WebRtcEngine) configuration() webrtc.Configuration {
+	return webrtc.Configuration{
+		ICEServers: tis.webrtcICEServers("server"),
+	}
+}
+
+// browserICEServer 浏览器 RTCIceServer
+type browserICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// browserICEServers 浏览器使用的ICE服务器
+func (tis *WebRtcEngine) browserICEServers() []browserICEServer {
+	result := []browserICEServer{}
+	for _, server := range tis.webrtcICEServers("browser") {
+		credential, _ := server.Credential.(string)
+		result = append(result, browserICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: credential,
+		})
+	}
+
+	// 内置TURN服务器, 每次生成新的用户名密码
+	if tis.turn != nil {
+		result = append(result, tis.turn.iceServer(newResourceID()[:8]))
+	}
+	return result
+}
+
+// ICEServers 浏览器使用的ICE服务器
+func (tis *WebRtcEngine) ICEServers(c *gin.Context) {
+	c.JSON(http.StatusOK, tis.browserICEServers())
+}
+
+// writeICELinks WHEP/WHIP 通过 Link 头返回ICE服务器
+func (tis *WebRtcEngine) writeICELinks(c *gin.Context) {
+	for _, server := range tis.browserICEServers() {
+		for _, u := range server.URLs {
+			link := fmt.Sprintf(`<%s>; rel="ice-server"`, u)
+			if server.Username != "" {
+				link += fmt.Sprintf(`; username="%s"; credential="%s"; credential-type="password"`,
+					strings.ReplaceAll(server.Username, `"`, ``), strings.ReplaceAll(server.Credential, `"`, ``))
+			}
+			c.Writer.Header().Add("Link", link)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestICEServers(t *testing.T) {
+	tests := []struct {
+		name      string
+		servers   []ICEServer
+		want      []browserICEServer
+		wantLinks []string
+	}{
+		{
+			name: "none",
+			want: []browserICEServer{},
+		},
+		{
+			name:      "stun",
+			servers:   []ICEServer{{URLs: []string{"stun:stun.example.com:3478"}}},
+			want:      []browserICEServer{{URLs: []string{"stun:stun.example.com:3478"}}},
+			wantLinks: []string{`<stun:stun.example.com:3478>; rel="ice-server"`},
+		},
+		{
+			name:    "turn",
+			servers: []ICEServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "pass"}},
+			want:    []browserICEServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "pass"}},
+			wantLinks: []string{
+				`<turn:turn.example.com:3478>; rel="ice-server"; username="user"; credential="pass"; credential-type="password"`,
+			},
+		},
+		{
+			// 使用secret时忽略静态用户名密码
+			name:    "turn rest api",
+			servers: []ICEServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "pass", Secret: "secret"}},
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &WebRtcEngine{}
+			WithICEServers(tt.servers...)(engine)
+
+			r := gin.New()
+			r.GET("/iceServers", engine.ICEServers)
+			r.GET("/links", func(c *gin.Context) {
+				engine.writeICELinks(c)
+				c.Status(http.StatusNoContent)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/iceServers", nil))
+			var got []browserICEServer
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("GET /iceServers = %d %s", w.Code, w.Body)
+			}
+
+			if tt.servers != nil && tt.servers[0].Secret != "" {
+				if len(got) != 1 || !strings.HasSuffix(got[0].Username, ":browser") ||
+					got[0].Credential != turnRESTPassword("secret", got[0].Username) {
+					t.Errorf("GET /iceServers = %+v, want a time-limited credential", got)
+				}
+
+				// 服务端使用自己的临时用户名
+				server := engine.configuration().ICEServers[0]
+				if !strings.HasSuffix(server.Username, ":server") || server.CredentialType != webrtc.ICECredentialTypePassword {
+					t.Errorf("configuration() = %+v", server)
+				}
+				return
+			}
+
+			data, _ := json.Marshal(got)
+			want, _ := json.Marshal(tt.want)
+			if string(data) != string(want) {
+				t.Errorf("GET /iceServers = %s, want %s", data, want)
+			}
+			if servers := engine.configuration().ICEServers; len(servers) != len(tt.servers) {
+				t.Errorf("configuration() = %+v", servers)
+			}
+
+			w = httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/links", nil))
+			if links := w.Header().Values("Link"); strings.Join(links, "\n") != strings.Join(tt.wantLinks, "\n") {
+				t.Errorf("Link = %q, want %q", links, tt.wantLinks)
+			}
+		})
+	}
+}
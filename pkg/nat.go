@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// NAT 1:1 映射, Docker或云主机端口映射时候选地址使用公网IP, 不需要STUN
+// 以及收集候选地址时的网卡/IP过滤
+
+// WithNAT1To1IPs 公网IP, 每项为 "公网IP" 或 "公网IP/内网IP"
+// candidateType 只支持 host, 替换host候选地址中的内网IP; srflx候选地址使用临时端口而不是UDP mux的端口, 启动时返回错误
+func WithNAT1To1IPs(candidateType webrtc.ICECandidateType, ips ...string) Option {
+	return func(tis *WebRtcEngine) {
+		tis.nat.candidateType = candidateType
+		tis.nat.ips = append(tis.nat.ips, ips...)
+	}
+}
+
+// WithInterfacePublicIP 网卡iface的地址映射为公网IP publicIP
+func WithInterfacePublicIP(iface string, publicIP string) Option {
+	return func(tis *WebRtcEngine) {
+		if tis.nat.interfaceIPs == nil {
+			tis.nat.interfaceIPs = map[string]string{}
+		}
+		tis.nat.interfaceIPs[iface] = publicIP
+	}
+}
+
+// WithInterfaceFilter 只在filter返回true的网卡上收集候选地址
+func WithInterfaceFilter(filter func(iface string) bool) Option {
+	return func(tis *WebRtcEngine) {
+		tis.nat.interfaceFilter = filter
+	}
+}
+
+// WithIPFilter 只在有地址使filter返回true的网卡上收集候选地址
+// pion没有按IP过滤的接口, 按网卡的地址过滤网卡
+func WithIPFilter(filter func(ip net.IP) bool) Option {
+	return func(tis *WebRtcEngine) {
+		tis.nat.ipFilter = filter
+	}
+}
+
+// natConfig NAT映射和候选地址过滤配置
+type natConfig struct {
+	candidateType   webrtc.ICECandidateType
+	ips             []string
+	interfaceIPs    map[string]string // 网卡 -> 公网IP
+	interfaceFilter func(string) bool
+	ipFilter        func(net.IP) bool
+}
+
+// nat1To1IPs 公网IP及网卡映射, 网卡映射转换为 公网IP/网卡IP
+func (tis *natConfig) nat1To1IPs() ([]string, error) {
+	result := append([]string{}, tis.ips...)
+
+	for name, publicIP := range tis.interfaceIPs {
+		public := net.ParseIP(publicIP)
+		if public == nil {
+			return nil, fmt.Errorf("nat: invalid public ip %q for %v", publicIP, name)
+		}
+
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("nat: %w", err)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("nat: %w", err)
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			// 同一地址族
+			if (ipNet.IP.To4() == nil) != (public.To4() == nil) {
+				continue
+			}
+			result = append(result, publicIP+"/"+ipNet.IP.String())
+		}
+	}
+
+	return result, nil
+}
+
+// filter 网卡过滤, 未配置时返回nil
+func (tis *natConfig) filter() func(string) bool {
+	if tis.interfaceFilter == nil && tis.ipFilter == nil {
+		return nil
+	}
+
+	return func(name string) bool {
+		if tis.interfaceFilter != nil && !tis.interfaceFilter(name) {
+			return false
+		}
+		if tis.ipFilter == nil {
+			return true
+		}
+
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return false
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && tis.ipFilter(ipNet.IP) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// apply 配置SettingEngine
+func (tis *natConfig) apply(settingEngine *webrtc.SettingEngine) error {
+	ips, err := tis.nat1To1IPs()
+	if err != nil {
+		return err
+	}
+	if len(ips) > 0 {
+		candidateType := tis.candidateType
+		if candidateType == webrtc.ICECandidateType(0) {
+			candidateType = webrtc.ICECandidateTypeHost
+		}
+		// 所有流量走UDP mux, pion的srflx候选地址在临时端口上收集, 映射后的端口不可达
+		if candidateType != webrtc.ICECandidateTypeHost {
+			return fmt.Errorf("nat: %v candidates are not gathered on the UDP mux, use host", candidateType)
+		}
+		settingEngine.SetNAT1To1IPs(ips, candidateType)
+	}
+
+	if filter := tis.filter(); filter != nil {
+		settingEngine.SetInterfaceFilter(filter)
+	}
+
+	return nil
+}
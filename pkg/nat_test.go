@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestNATApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		nat     natConfig
+		wantErr bool
+	}{
+		{"empty", natConfig{}, false},
+		{"default host", natConfig{ips: []string{"203.0.113.1"}}, false},
+		{"host", natConfig{candidateType: webrtc.ICECandidateTypeHost, ips: []string{"203.0.113.1/10.0.0.2"}}, false},
+		// srflx候选地址不经过UDP mux
+		{"srflx", natConfig{candidateType: webrtc.ICECandidateTypeSrflx, ips: []string{"203.0.113.1"}}, true},
+		{"srflx without ip", natConfig{candidateType: webrtc.ICECandidateTypeSrflx}, false},
+		{"invalid interface ip", natConfig{interfaceIPs: map[string]string{"lo": "not-an-ip"}}, true},
+		{"unknown interface", natConfig{interfaceIPs: map[string]string{"no-such-iface0": "203.0.113.1"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settingEngine := webrtc.SettingEngine{}
+			if err := tt.nat.apply(&settingEngine); (err != nil) != tt.wantErr {
+				t.Errorf("apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNATFilter(t *testing.T) {
+	if filter := (&natConfig{}).filter(); filter != nil {
+		t.Error("filter() without filters should be nil")
+	}
+
+	loopback := func(ip net.IP) bool { return ip.IsLoopback() }
+	onlyEth0 := func(name string) bool { return name == "eth0" }
+
+	tests := []struct {
+		name  string
+		nat   natConfig
+		iface string
+		want  bool
+	}{
+		{"interface filter", natConfig{interfaceFilter: onlyEth0}, "eth0", true},
+		{"interface filtered", natConfig{interfaceFilter: onlyEth0}, "lo", false},
+		{"ip filter", natConfig{ipFilter: loopback}, "lo", true},
+		{"ip filter unknown interface", natConfig{ipFilter: loopback}, "no-such-iface0", false},
+		{"both", natConfig{interfaceFilter: onlyEth0, ipFilter: loopback}, "lo", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.nat.filter()(tt.iface); got != tt.want {
+				t.Errorf("filter()(%q) = %v, want %v", tt.iface, got, tt.want)
+			}
+		})
+	}
+}
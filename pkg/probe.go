@@ -0,0 +1,49 @@
+package pkg
+
+// ProbeTrack rtsp DESCRIBE 得到的track
+type ProbeTrack struct {
+	Control string
+	Media   string
+	Name    string
+	// Codec 对应的webrtc编码, 不支持时为空
+	Codec string
+}
+
+// Probe 按config连接rtsp地址并DESCRIBE, 返回各track及对应的webrtc编码
+func Probe(address string, config RtspConfig) ([]ProbeTrack, error) {
+	u, err := config.url(address)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := config.newClient()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Start(u.Scheme, u.Host); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+
+	tracks, _, _, err := c.Describe(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ProbeTrack
+	for _, track := range tracks {
+		t := ProbeTrack{
+			Control: track.GetControl(),
+			Media:   track.MediaDescription().MediaName.Media,
+			Name:    trackName(track),
+		}
+		if codec, ok := codecFromTrack(track); ok {
+			t.Codec = codec.MimeType
+		}
+		result = append(result, t)
+	}
+
+	return result, nil
+}
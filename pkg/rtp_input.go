@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// UDP RTP输入
+// 每个输入监听一个端口, 注册为一路流, 任意多个观看者通过 GetWebrtc / signaling?mode=get 订阅
+// ffmpeg -re -f lavfi -i testsrc=size=640x480:rate=30 -pix_fmt yuv420p -c:v libx264 -g 10 -preset ultrafast -tune zerolatency -f rtp rtp://127.0.0.1:5004?pkt_size=1200
+// ffmpeg -re -i input.mp4 -an -pix_fmt yuv420p -c:v libx264 -g 0.01 -preset ultrafast -tune zerolatency -f rtp rtp://127.0.0.1:5004?pkt_size=1200
+
+// DefaultRTPInputCodec RTP输入默认编码
+const DefaultRTPInputCodec = "H264"
+
+// RTPInput 一个UDP RTP输入
+type RTPInput struct {
+	// Name 流名称
+	Name string
+	// Address 监听地址, 如 127.0.0.1:5004
+	Address string
+	// Codec 编码名称, 如 H264, VP8, opus, 默认 DefaultRTPInputCodec
+	Codec string
+}
+
+// WithRTPInputs UDP RTP输入, 引擎创建时监听, Close时关闭
+func WithRTPInputs(inputs ...RTPInput) Option {
+	return func(tis *WebRtcEngine) {
+		tis.rtpInputs = append(tis.rtpInputs, inputs...)
+	}
+}
+
+// rtpInput 一个监听中的RTP输入
+type rtpInput struct {
+	listener *net.UDPConn
+	stream   *Stream
+}
+
+// startRTPInput 监听端口并注册流
+func startRTPInput(streams *StreamRegistry, input RTPInput) (*rtpInput, error) {
+	codecName := input.Codec
+	if codecName == "" {
+		codecName = DefaultRTPInputCodec
+	}
+	codec, err := codecFromName(codecName)
+	if err != nil {
+		return nil, fmt.Errorf("rtp input %v: %w", input.Name, err)
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", input.Address)
+	if err != nil {
+		return nil, fmt.Errorf("rtp input %v: %w", input.Name, err)
+	}
+
+	stream, err := streams.Publish(streamName(input.Name))
+	if err != nil {
+		return nil, err
+	}
+	stream.AddTrack(codec)
+	stream.Ready()
+
+	listener, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("rtp input %v: %w", input.Name, err)
+	}
+
+	log.Printf("[rtp] %v %v listening at %v", stream.Name(), codec.MimeType, listener.LocalAddr())
+
+	tis := &rtpInput{
+		listener: listener,
+		stream:   stream,
+	}
+	go tis.run()
+
+	return tis, nil
+}
+
+// run 读取RTP转发给订阅者, 端口关闭后移除流
+func (tis *rtpInput) run() {
+	defer tis.stream.Close()
+
+	pkt := &rtp.Packet{}
+	buf := make([]byte, 1600) // UDP MTU
+	for {
+		n, _, err := tis.listener.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if err = pkt.Unmarshal(buf[:n]); err != nil {
+			continue
+		}
+		tis.stream.WriteRTP(0, pkt)
+	}
+}
+
+// close 关闭端口
+func (tis *rtpInput) close() error {
+	return tis.listener.Close()
+}
+
+// Rtp rtp转webrtc, 监听127.0.0.1:udpPort, 收到的RTP写入videoTrack, 阻塞到PeerConnection断开或端口关闭
+// 端口被占用时返回
+//
+// Deprecated: 使用 WithRTPInputs 注册为流, 观看者通过 Stream.Subscribe 订阅, 共用一个端口.
+func Rtp(udpPort int, _ *webrtc.PeerConnection, videoTrack *webrtc.TrackLocalStaticRTP) {
+	input, err := startRTPInput(NewStreamRegistry(), RTPInput{
+		Name:    "rtp",
+		Address: net.JoinHostPort("127.0.0.1", strconv.Itoa(udpPort)),
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer func() {
+		_ = input.close()
+	}()
+
+	closed := make(chan struct{})
+	var closeOnce sync.Once
+	cancel := input.stream.addReader(func(trackIndex int, pkt *rtp.Packet) {
+		if err := videoTrack.WriteRTP(pkt); errors.Is(err, io.ErrClosedPipe) {
+			// The peerConnection has been closed.
+			closeOnce.Do(func() { close(closed) })
+		}
+	})
+	defer cancel()
+
+	select {
+	case <-closed:
+	case <-input.stream.Done():
+	}
+}
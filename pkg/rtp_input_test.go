@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestStartRTPInput(t *testing.T) {
+	inUse, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = inUse.Close() }()
+
+	tests := []struct {
+		name    string
+		input   RTPInput
+		wantErr bool
+	}{
+		{"h264", RTPInput{Name: "cam1", Address: "127.0.0.1:0"}, false},
+		{"opus", RTPInput{Name: "mic", Address: "127.0.0.1:0", Codec: "opus"}, false},
+		{"port in use", RTPInput{Name: "cam1", Address: inUse.LocalAddr().String()}, true},
+		{"unknown codec", RTPInput{Name: "cam1", Address: "127.0.0.1:0", Codec: "mjpeg"}, true},
+		{"invalid address", RTPInput{Name: "cam1", Address: "127.0.0.1:port"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streams := NewStreamRegistry()
+			input, err := startRTPInput(streams, tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("startRTPInput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				// 失败时不留下流, 名称可以再次使用
+				if _, err = streams.Get(tt.input.Name); !errors.Is(err, ErrStreamNotFound) {
+					t.Errorf("Get() after failure error = %v, want ErrStreamNotFound", err)
+				}
+				return
+			}
+
+			stream, err := streams.Get(tt.input.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stream.isReady() {
+				t.Error("stream is not ready")
+			}
+
+			// 关闭端口后移除流
+			_ = input.close()
+			select {
+			case <-stream.Done():
+			case <-time.After(time.Second):
+				t.Fatal("stream is not closed with the input")
+			}
+		})
+	}
+}
+
+func TestRtpPortInUse(t *testing.T) {
+	inUse, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = inUse.Close() }()
+
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "rtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 端口被占用时返回, 不panic
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Rtp(inUse.LocalAddr().(*net.UDPAddr).Port, nil, track)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Rtp() does not return when the port is in use")
+	}
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// rtpRewriter 重写序号和时间戳, rtsp重连后接着上一个会话, 浏览器解码器不会因跳变出错
+type rtpRewriter struct {
+	clockRate uint32
+
+	started   bool // 收到过包
+	resync    bool // 下一个包重新计算偏移
+	seqOffset uint16
+	tsOffset  uint32
+
+	lastSeq  uint16
+	lastTS   uint32
+	lastTime time.Time
+}
+
+func newRTPRewriter(clockRate uint32) *rtpRewriter {
+	return &rtpRewriter{
+		clockRate: clockRate,
+	}
+}
+
+// reset 新的rtsp会话开始
+func (tis *rtpRewriter) reset() {
+	tis.resync = true
+}
+
+// process 重写pkt的序号和时间戳
+func (tis *rtpRewriter) process(pkt *rtp.Packet) {
+	if tis.resync && tis.started {
+		// 时间戳按断开的时长前进
+		elapsed := uint32(time.Since(tis.lastTime).Seconds() * float64(tis.clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+
+		tis.seqOffset = tis.lastSeq + 1 - pkt.SequenceNumber
+		tis.tsOffset = tis.lastTS + elapsed - pkt.Timestamp
+	}
+	tis.resync = false
+
+	pkt.SequenceNumber += tis.seqOffset
+	pkt.Timestamp += tis.tsOffset
+
+	tis.started = true
+	tis.lastSeq, tis.lastTS, tis.lastTime = pkt.SequenceNumber, pkt.Timestamp, time.Now()
+}
@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestRTPRewriter(t *testing.T) {
+	type packet struct {
+		seq uint16
+		ts  uint32
+	}
+
+	tests := []struct {
+		name  string
+		first []packet // 第一个rtsp会话
+		next  []packet // 重连后的会话
+		// 重连后的包相对上一个会话最后一个包的序号差
+		wantSeq []uint16
+	}{
+		{
+			name:    "no reconnect",
+			first:   []packet{{100, 1000}, {101, 4000}, {102, 7000}},
+			wantSeq: nil,
+		},
+		{
+			name:    "sequence restarts",
+			first:   []packet{{100, 1000}, {101, 4000}},
+			next:    []packet{{0, 0}, {1, 3000}, {2, 6000}},
+			wantSeq: []uint16{1, 2, 3},
+		},
+		{
+			name:    "sequence wraps",
+			first:   []packet{{65534, 1000}, {65535, 4000}},
+			next:    []packet{{5000, 90000}, {5001, 93000}},
+			wantSeq: []uint16{1, 2},
+		},
+		{
+			name:    "timestamp wraps",
+			first:   []packet{{10, 4294967000}},
+			next:    []packet{{20, 100}, {21, 3100}},
+			wantSeq: []uint16{1, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rewriter := newRTPRewriter(90000)
+
+			var last *rtp.Packet
+			for _, p := range tt.first {
+				pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: p.seq, Timestamp: p.ts}}
+				rewriter.process(pkt)
+				// 第一个会话不改写
+				if pkt.SequenceNumber != p.seq || pkt.Timestamp != p.ts {
+					t.Fatalf("first session rewritten: %d/%d -> %d/%d", p.seq, p.ts, pkt.SequenceNumber, pkt.Timestamp)
+				}
+				last = pkt
+			}
+			if len(tt.next) == 0 {
+				return
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			rewriter.reset()
+			end := *last
+
+			for i, p := range tt.next {
+				pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: p.seq, Timestamp: p.ts}}
+				rewriter.process(pkt)
+
+				if got := pkt.SequenceNumber - end.SequenceNumber; got != tt.wantSeq[i] {
+					t.Errorf("packet %d seq delta = %d, want %d", i, got, tt.wantSeq[i])
+				}
+				// 时间戳继续递增, 差值与原会话相同
+				delta := pkt.Timestamp - last.Timestamp
+				if i == 0 {
+					// 第一个包按断开时长前进, 至少1
+					if delta == 0 || delta > 90000 {
+						t.Errorf("packet %d ts delta = %d", i, delta)
+					}
+				} else if want := p.ts - tt.next[i-1].ts; delta != want {
+					t.Errorf("packet %d ts delta = %d, want %d", i, delta, want)
+				}
+				last = pkt
+			}
+		})
+	}
+}
+
+func TestRTPRewriterResetBeforeFirstPacket(t *testing.T) {
+	// 还没收到包时reset不改写
+	rewriter := newRTPRewriter(48000)
+	rewriter.reset()
+
+	pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: 7, Timestamp: 960}}
+	rewriter.process(pkt)
+	if pkt.SequenceNumber != 7 || pkt.Timestamp != 960 {
+		t.Errorf("packet rewritten to %d/%d", pkt.SequenceNumber, pkt.Timestamp)
+	}
+}
@@ -0,0 +1,200 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/url"
+)
+
+// rtsp客户端参数, 对应 rtsp-simple-server 的 readTimeout, writeTimeout, readBufferCount, sourceProtocol, sourceFingerprint
+// 用户名密码不放在地址中, 连接时才加到地址上, 日志及会话信息中的地址不含密码
+
+const (
+	// RtspTransportAuto 先尝试UDP, 失败后使用TCP
+	RtspTransportAuto = "automatic"
+	// RtspTransportUDP UDP
+	RtspTransportUDP = "udp"
+	// RtspTransportMulticast UDP组播, 只能用于拉流
+	RtspTransportMulticast = "multicast"
+	// RtspTransportTCP TCP交织, 适合跨VPN/NAT
+	RtspTransportTCP = "tcp"
+)
+
+// RtspConfig rtsp客户端参数, 零值使用gortsplib的默认值
+type RtspConfig struct {
+	// Transport RtspTransportAuto (默认), RtspTransportUDP, RtspTransportMulticast, RtspTransportTCP
+	Transport string
+	// AnyPortEnable 允许服务器不提供或使用其它UDP端口, 有安全风险
+	AnyPortEnable bool
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// ReadBufferCount 须为2的幂
+	ReadBufferCount  int
+	WriteBufferCount int
+
+	// Username, Password 替换地址中的用户名密码
+	Username string
+	Password string
+
+	// Fingerprint rtsps服务器证书的SHA256指纹 (hex), 设置后不校验证书链, 用于自签名证书
+	Fingerprint string
+	// CAFile 校验rtsps服务器证书的CA (PEM), 为空时使用系统CA
+	CAFile string
+}
+
+// WithRtspConfig 所有rtsp拉流/推流的默认参数
+func WithRtspConfig(config RtspConfig) Option {
+	return func(tis *WebRtcEngine) {
+		tis.sources.config = config
+	}
+}
+
+// WithSourceRtspConfig rtsp地址address使用的参数, 替换默认参数
+func WithSourceRtspConfig(address string, config RtspConfig) Option {
+	return func(tis *WebRtcEngine) {
+		if tis.sources.configs == nil {
+			tis.sources.configs = map[string]RtspConfig{}
+		}
+		tis.sources.configs[address] = config
+	}
+}
+
+// transport gortsplib的传输方式, 自动时为nil
+func (tis RtspConfig) transport() (*gortsplib.Transport, error) {
+	var transport gortsplib.Transport
+	switch strings.ToLower(tis.Transport) {
+	case "", "auto", RtspTransportAuto:
+		return nil, nil
+	case RtspTransportUDP:
+		transport = gortsplib.TransportUDP
+	case RtspTransportMulticast:
+		transport = gortsplib.TransportUDPMulticast
+	case RtspTransportTCP:
+		transport = gortsplib.TransportTCP
+	default:
+		return nil, fmt.Errorf("invalid rtsp transport '%s'", tis.Transport)
+	}
+	return &transport, nil
+}
+
+// tlsConfig rtsps的TLS配置, 未设置指纹和CA时为nil (系统CA校验)
+func (tis RtspConfig) tlsConfig() (*tls.Config, error) {
+	if tis.Fingerprint != "" {
+		fingerprint := strings.ToLower(strings.ReplaceAll(tis.Fingerprint, ":", ""))
+		if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid rtsps fingerprint '%s'", tis.Fingerprint)
+		}
+
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				if len(cs.PeerCertificates) == 0 {
+					return fmt.Errorf("rtsps server sent no certificate")
+				}
+				sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+				if got := hex.EncodeToString(sum[:]); got != fingerprint {
+					return fmt.Errorf("rtsps server fingerprint mismatch: expected %s, got %s", fingerprint, got)
+				}
+				return nil
+			},
+		}, nil
+	}
+
+	if tis.CAFile != "" {
+		data, err := os.ReadFile(tis.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate in rtsps CA file %s", tis.CAFile)
+		}
+
+		return &tls.Config{RootCAs: pool}, nil
+	}
+
+	return nil, nil
+}
+
+// url 解析地址并加上用户名密码
+func (tis RtspConfig) url(address string) (*url.URL, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if tis.Username != "" {
+		u.User = neturl.UserPassword(tis.Username, tis.Password)
+	}
+	return u, nil
+}
+
+// redactAddress 去掉地址中的用户名密码, 用于日志
+func redactAddress(address string) string {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "(invalid url)"
+	}
+	return u.CloneWithoutCredentials().String()
+}
+
+// sourceName rtsp拉流的流名称, 不含密码; 地址带用户名密码时加上其摘要, 不同用户的会话名称不同
+func sourceName(address string) string {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "(invalid url)"
+	}
+
+	name := u.CloneWithoutCredentials().String()
+	if u.User != nil {
+		sum := sha256.Sum256([]byte(u.User.String()))
+		name += "#" + hex.EncodeToString(sum[:4])
+	}
+	return name
+}
+
+// validate 检查参数
+func (tis RtspConfig) validate() error {
+	if _, err := tis.transport(); err != nil {
+		return err
+	}
+	if n := tis.ReadBufferCount; n != 0 && (n < 0 || n&(n-1) != 0) {
+		return fmt.Errorf("rtsp read buffer count %d must be a power of two", n)
+	}
+	if tis.WriteBufferCount < 0 {
+		return fmt.Errorf("invalid rtsp write buffer count %d", tis.WriteBufferCount)
+	}
+	if _, err := tis.tlsConfig(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newClient 按参数创建rtsp客户端
+func (tis RtspConfig) newClient() (*gortsplib.Client, error) {
+	if err := tis.validate(); err != nil {
+		return nil, err
+	}
+	transport, _ := tis.transport()
+	tlsConfig, _ := tis.tlsConfig()
+
+	return &gortsplib.Client{
+		Transport:        transport,
+		TLSConfig:        tlsConfig,
+		AnyPortEnable:    tis.AnyPortEnable,
+		ReadTimeout:      tis.ReadTimeout,
+		WriteTimeout:     tis.WriteTimeout,
+		ReadBufferCount:  tis.ReadBufferCount,
+		WriteBufferCount: tis.WriteBufferCount,
+	}, nil
+}
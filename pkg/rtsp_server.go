@@ -0,0 +1,472 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/auth"
+	"github.com/aler9/gortsplib/pkg/base"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// 内置rtsp服务器, 不需要单独运行 rtsp-simple-server
+// DESCRIBE/SETUP/PLAY: 读取引擎中的流 (webrtc推流, RTP输入), rtsp://host:8554/<stream>
+//   以及配置的路径 (WithPaths), 第一个读者到来时通过 SourceManager 拉流, 与webrtc观看者共用rtsp会话
+// ANNOUNCE/RECORD: rtsp推流, 转发给rtsp读者, 同时注册为引擎中的流, webrtc观看者通过 GetWebrtc 等订阅
+//   推流名称需通过白名单 (WithAllowedSources), 不能是配置的路径
+// 设置 User 后 DESCRIBE/ANNOUNCE/SETUP 需要认证 (Basic/Digest)
+
+// DefaultRtspAddress 内置rtsp服务器默认监听地址
+const DefaultRtspAddress = ":8554"
+
+// RtspListenConfig 内置rtsp服务器
+type RtspListenConfig struct {
+	// Address rtsp监听地址, 默认 DefaultRtspAddress
+	Address string
+	// UDPRTPAddress, UDPRTCPAddress UDP传输的端口, 如 :8000 :8001, 为空时只支持TCP
+	UDPRTPAddress  string
+	UDPRTCPAddress string
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// User, Pass rtsp认证, User为空时不认证
+	User string
+	Pass string
+}
+
+// WithRtspListen 启动内置rtsp服务器; 推流到rtspServer下的路径时不再推给外部服务器, 由内置服务器直接提供
+func WithRtspListen(config RtspListenConfig) Option {
+	return func(tis *WebRtcEngine) {
+		tis.rtspListen = &config
+	}
+}
+
+// defaultRtspDescribeTimeout 读取配置的路径时等待拉流的时间
+const defaultRtspDescribeTimeout = 10 * time.Second
+
+// rtspListener 内置rtsp服务器
+type rtspListener struct {
+	streams *StreamRegistry
+	sources *SourceManager
+	remotes map[string]string // 配置的路径: 流名称 -> rtsp地址
+	timeout time.Duration
+	server  *gortsplib.Server
+
+	// validator 认证, 为nil时不认证; allow 校验推流名称, 为nil时不校验
+	validator *auth.Validator
+	allow     func(name string) error
+
+	mutex sync.Mutex
+	paths map[string]*rtspPath // 流名称 -> 路径
+
+	// 会话 -> 路径, 推流者在ANNOUNCE时, 拉流路径的读者在PLAY时保存; OnPacketRTP 不加锁读取
+	sessions sync.Map
+}
+
+// rtspPath 一路rtsp流
+type rtspPath struct {
+	name   string
+	stream *gortsplib.ServerStream
+
+	// 引擎中的流
+	source       *Stream
+	payloadTypes []uint8
+	cancel       func()
+
+	// 配置的路径, 通过 SourceManager 拉流; 没有读者时关闭, 以下字段受 rtspListener.mutex 保护
+	subscriber *Subscriber
+	readers    int
+	linger     *time.Timer
+	removed    bool
+
+	// ANNOUNCE的推流者, rtsp track id -> 引擎流的track序号, 不支持的track为-1
+	publisher    *gortsplib.ServerSession
+	trackIndexes []int
+}
+
+// startRtspListener 启动内置rtsp服务器, remotes为通过sources拉流提供的路径, allow校验推流名称
+func startRtspListener(streams *StreamRegistry, sources *SourceManager, remotes map[string]string, allow func(name string) error, config RtspListenConfig) (*rtspListener, error) {
+	if config.Address == "" {
+		config.Address = DefaultRtspAddress
+	}
+
+	tis := &rtspListener{
+		streams: streams,
+		sources: sources,
+		remotes: remotes,
+		timeout: config.ReadTimeout,
+		allow:   allow,
+		paths:   map[string]*rtspPath{},
+	}
+	if config.User != "" {
+		tis.validator = auth.NewValidator(config.User, config.Pass, nil)
+	}
+	if tis.timeout <= 0 {
+		tis.timeout = defaultRtspDescribeTimeout
+	}
+	tis.server = &gortsplib.Server{
+		Handler:        tis,
+		RTSPAddress:    config.Address,
+		UDPRTPAddress:  config.UDPRTPAddress,
+		UDPRTCPAddress: config.UDPRTCPAddress,
+		ReadTimeout:    config.ReadTimeout,
+		WriteTimeout:   config.WriteTimeout,
+	}
+	if err := tis.server.Start(); err != nil {
+		return nil, fmt.Errorf("rtsp server: %w", err)
+	}
+
+	log.Printf("Listening for RTSP at %s\n", config.Address)
+
+	return tis, nil
+}
+
+// close 关闭服务器, 断开所有读者和推流者
+func (tis *rtspListener) close() error {
+	return tis.server.Close()
+}
+
+// path 获取路径, 引擎中的流或配置的路径第一次被读取时创建
+func (tis *rtspListener) path(name string) (*rtspPath, error) {
+	tis.mutex.Lock()
+	p, err := tis.localPath(name)
+	tis.mutex.Unlock()
+
+	address, ok := tis.remotes[name]
+	if err == nil || !errors.Is(err, ErrStreamNotFound) || !ok {
+		return p, err
+	}
+
+	// 配置的路径, 不持有锁等待拉流
+	ctx, cancel := context.WithTimeout(context.Background(), tis.timeout)
+	defer cancel()
+	subscriber, err := tis.sources.Subscribe(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	// 等待期间其它读者已创建路径
+	if p, ok := tis.paths[name]; ok {
+		subscriber.Close()
+		return p, nil
+	}
+
+	if p, err = tis.newPath(name, subscriber.Stream()); err != nil {
+		subscriber.Close()
+		return nil, err
+	}
+	p.subscriber = subscriber
+	tis.lingerPath(p)
+
+	return p, nil
+}
+
+// localPath 已有的路径或引擎中的流, 调用时需持有锁
+func (tis *rtspListener) localPath(name string) (*rtspPath, error) {
+	if p, ok := tis.paths[name]; ok {
+		return p, nil
+	}
+
+	source, err := tis.streams.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return tis.newPath(name, source)
+}
+
+// newPath 为流创建路径, 调用时需持有锁
+func (tis *rtspListener) newPath(name string, source *Stream) (*rtspPath, error) {
+	if !source.isReady() {
+		return nil, fmt.Errorf("%w: %s", ErrStreamNotReady, name)
+	}
+	codecs := source.Codecs()
+
+	p := &rtspPath{
+		name:   name,
+		source: source,
+	}
+
+	var tracks gortsplib.Tracks
+	for i, codec := range codecs {
+		pt := rtspPayloadType(codec, i)
+		track, err := trackFromCodec(webrtc.RTPCodecParameters{RTPCodecCapability: codec, PayloadType: webrtc.PayloadType(pt)})
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, track)
+		p.payloadTypes = append(p.payloadTypes, pt)
+	}
+	p.stream = gortsplib.NewServerStream(tracks)
+
+	// 流的RTP转发给rtsp读者, 负载类型改为rtsp track的负载类型
+	p.cancel = source.addReader(func(trackIndex int, pkt *rtp.Packet) {
+		if trackIndex >= len(p.payloadTypes) {
+			return
+		}
+		out := *pkt
+		out.PayloadType = p.payloadTypes[trackIndex]
+		p.stream.WritePacketRTP(trackIndex, &out, true)
+	})
+
+	// 流结束后断开rtsp读者
+	go func() {
+		<-source.Done()
+		tis.removePath(p)
+	}()
+
+	tis.paths[name] = p
+
+	return p, nil
+}
+
+// lingerPath 拉流路径没有读者时延迟关闭, 只DESCRIBE不PLAY的读者也不会一直占用拉流; 调用时需持有锁
+func (tis *rtspListener) lingerPath(p *rtspPath) {
+	if p.subscriber == nil || p.readers > 0 || p.removed {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(tis.sources.linger, func() {
+		tis.mutex.Lock()
+		idle := p.readers == 0 && p.linger == timer
+		tis.mutex.Unlock()
+
+		if idle {
+			log.Printf("[rtsp server] no reader, close %v", p.name)
+			tis.removePath(p)
+		}
+	})
+	p.linger = timer
+}
+
+// removePath 移除路径并断开读者
+func (tis *rtspListener) removePath(p *rtspPath) {
+	tis.mutex.Lock()
+	if p.removed {
+		tis.mutex.Unlock()
+		return
+	}
+	p.removed = true
+	if tis.paths[p.name] == p {
+		delete(tis.paths, p.name)
+	}
+	if p.linger != nil {
+		p.linger.Stop()
+		p.linger = nil
+	}
+	tis.mutex.Unlock()
+
+	if p.publisher != nil {
+		tis.sessions.Delete(p.publisher)
+	}
+	if p.cancel != nil {
+		p.cancel()
+	}
+	// 推流者离开, webrtc观看者随之断开
+	if p.publisher != nil {
+		p.source.Close()
+	}
+	if p.subscriber != nil {
+		p.subscriber.Close()
+	}
+	_ = p.stream.Close()
+}
+
+// rtspPayloadType rtsp track的负载类型, PCMU/PCMA使用静态负载类型
+func rtspPayloadType(codec webrtc.RTPCodecCapability, index int) uint8 {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypePCMU):
+		return 0
+	case strings.ToLower(webrtc.MimeTypePCMA):
+		return 8
+	}
+	return uint8(96 + index)
+}
+
+// authenticate 校验请求的认证信息, 失败时返回401
+// 没有认证信息时不返回错误, 保持连接, 客户端带上认证信息重试
+func (tis *rtspListener) authenticate(req *base.Request) (*base.Response, error) {
+	if tis.validator == nil {
+		return nil, nil
+	}
+
+	res := &base.Response{
+		StatusCode: base.StatusUnauthorized,
+		Header:     base.Header{"WWW-Authenticate": tis.validator.Header()},
+	}
+	if _, ok := req.Header["Authorization"]; !ok {
+		return res, nil
+	}
+	if err := tis.validator.ValidateRequest(req); err != nil {
+		return res, fmt.Errorf("rtsp authentication failed: %w", err)
+	}
+	return nil, nil
+}
+
+// rtspErrorStatus 获取路径错误对应的rtsp状态码
+func rtspErrorStatus(err error) base.StatusCode {
+	if errors.Is(err, ErrStreamNotFound) || errors.Is(err, ErrStreamNotReady) {
+		return base.StatusNotFound
+	}
+	if errors.Is(err, ErrSourceNotAllowed) {
+		return base.StatusForbidden
+	}
+	return base.StatusBadRequest
+}
+
+// OnSessionClose 推流者断开后移除路径, 拉流路径的最后一个读者断开后延迟关闭
+func (tis *rtspListener) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCtx) {
+	v, ok := tis.sessions.LoadAndDelete(ctx.Session)
+	if !ok {
+		return
+	}
+	p := v.(*rtspPath)
+
+	if p.publisher == ctx.Session {
+		log.Printf("[rtsp server] publisher of %v left", p.name)
+		tis.removePath(p)
+		return
+	}
+
+	tis.mutex.Lock()
+	p.readers--
+	tis.lingerPath(p)
+	tis.mutex.Unlock()
+}
+
+// OnDescribe 读者获取流的track
+func (tis *rtspListener) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	if res, err := tis.authenticate(ctx.Request); res != nil {
+		return res, nil, err
+	}
+
+	p, err := tis.path(streamName(ctx.Path))
+	if err != nil {
+		return &base.Response{StatusCode: rtspErrorStatus(err)}, nil, err
+	}
+
+	return &base.Response{StatusCode: base.StatusOK}, p.stream, nil
+}
+
+// OnAnnounce rtsp推流, 注册为引擎中的流
+func (tis *rtspListener) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*base.Response, error) {
+	if res, err := tis.authenticate(ctx.Request); res != nil {
+		return res, err
+	}
+
+	name := streamName(ctx.Path)
+	if tis.allow != nil {
+		if err := tis.allow(name); err != nil {
+			return &base.Response{StatusCode: rtspErrorStatus(err)}, err
+		}
+	}
+
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if _, ok := tis.paths[name]; ok {
+		return &base.Response{StatusCode: base.StatusBadRequest}, fmt.Errorf("%w: %s", ErrStreamExists, name)
+	}
+
+	// 与webrtc推流共用注册表, 同名时失败
+	source, err := tis.streams.Publish(name)
+	if err != nil {
+		return &base.Response{StatusCode: base.StatusBadRequest}, err
+	}
+
+	p := &rtspPath{
+		name:      name,
+		stream:    gortsplib.NewServerStream(ctx.Tracks),
+		source:    source,
+		publisher: ctx.Session,
+	}
+
+	// webrtc支持的track加入引擎流, 其它track只转发给rtsp读者
+	for _, track := range ctx.Tracks {
+		index := -1
+		if codec, ok := codecFromTrack(track); ok {
+			index = source.AddTrack(codec)
+		}
+		p.trackIndexes = append(p.trackIndexes, index)
+
+		log.Printf("[rtsp server] publish %v %v, webrtc track %d", name, trackName(track), index)
+	}
+	source.Ready()
+
+	tis.paths[name] = p
+	tis.sessions.Store(ctx.Session, p)
+
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+// OnSetup 读者或推流者setup track
+func (tis *rtspListener) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	if res, err := tis.authenticate(ctx.Request); res != nil {
+		return res, nil, err
+	}
+
+	p, err := tis.path(streamName(ctx.Path))
+	if err != nil {
+		return &base.Response{StatusCode: rtspErrorStatus(err)}, nil, err
+	}
+
+	return &base.Response{StatusCode: base.StatusOK}, p.stream, nil
+}
+
+// OnPlay 读者开始播放, 拉流路径记录读者
+func (tis *rtspListener) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+	name := streamName(ctx.Path)
+	log.Printf("[rtsp server] play %v", name)
+
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	p, ok := tis.paths[name]
+	if !ok {
+		return &base.Response{StatusCode: base.StatusNotFound}, fmt.Errorf("%w: %s", ErrStreamNotFound, name)
+	}
+	if p.subscriber != nil {
+		if _, loaded := tis.sessions.LoadOrStore(ctx.Session, p); !loaded {
+			p.readers++
+			if p.linger != nil {
+				p.linger.Stop()
+				p.linger = nil
+			}
+		}
+	}
+
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+// OnRecord 推流者开始推流
+func (tis *rtspListener) OnRecord(ctx *gortsplib.ServerHandlerOnRecordCtx) (*base.Response, error) {
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+// OnPacketRTP 推流者的RTP转发给rtsp读者和webrtc观看者
+func (tis *rtspListener) OnPacketRTP(ctx *gortsplib.ServerHandlerOnPacketRTPCtx) {
+	v, ok := tis.sessions.Load(ctx.Session)
+	if !ok {
+		return
+	}
+	p := v.(*rtspPath)
+	if p.publisher != ctx.Session {
+		return
+	}
+
+	p.stream.WritePacketRTP(ctx.TrackID, ctx.Packet, ctx.PTSEqualsDTS)
+	if ctx.TrackID < len(p.trackIndexes) && p.trackIndexes[ctx.TrackID] >= 0 {
+		p.source.WriteRTP(p.trackIndexes[ctx.TrackID], ctx.Packet)
+	}
+}
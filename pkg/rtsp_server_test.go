@@ -0,0 +1,392 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/url"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// playTestRtsp 播放rtsp地址, 收到的RTP包写入返回的chan
+func playTestRtsp(t *testing.T, address string) (*gortsplib.Client, gortsplib.Tracks, <-chan *rtp.Packet, error) {
+	t.Helper()
+
+	u, err := url.Parse(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := make(chan *rtp.Packet, 100)
+	c := &gortsplib.Client{
+		OnPacketRTP: func(ctx *gortsplib.ClientOnPacketRTPCtx) {
+			select {
+			case packets <- ctx.Packet:
+			default:
+			}
+		},
+	}
+	if err = c.Start(u.Scheme, u.Host); err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, baseURL, _, err := c.Describe(u)
+	if err == nil {
+		err = c.SetupAndPlay(tracks, baseURL)
+	}
+	if err != nil {
+		_ = c.Close()
+		return nil, nil, nil, err
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	return c, tracks, packets, nil
+}
+
+// waitTestPacket 反复写入RTP包, 直到读者收到
+func waitTestPacket(t *testing.T, stream *Stream, packets <-chan *rtp.Packet) *rtp.Packet {
+	t.Helper()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(3 * time.Second)
+
+	for seq := uint16(1); ; seq++ {
+		select {
+		case pkt := <-packets:
+			return pkt
+		case <-ticker.C:
+			stream.WriteRTP(0, &rtp.Packet{
+				Header:  rtp.Header{Version: 2, PayloadType: 102, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true},
+				Payload: []byte{0x65, 0x88, 0x84},
+			})
+		case <-timeout:
+			t.Fatal("no packet received")
+			return nil
+		}
+	}
+}
+
+func TestRtspServerRead(t *testing.T) {
+	streams := NewStreamRegistry()
+	server := startTestRtspServer(t, streams)
+	stream := publishTestStream(t, streams, "live/cam1")
+
+	pending, err := streams.Publish("pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pending.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "engine stream", path: "/live/cam1"},
+		{name: "not found", path: "/missing", wantErr: true},
+		{name: "not ready", path: "/pending", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, tracks, packets, err := playTestRtsp(t, server+tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("play should fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(tracks) != 1 {
+				t.Fatalf("len(tracks) = %d, want 1", len(tracks))
+			}
+			if codec, ok := codecFromTrack(tracks[0]); !ok || codec.MimeType != webrtc.MimeTypeH264 {
+				t.Errorf("track codec = %v", codec.MimeType)
+			}
+
+			// 负载类型改为rtsp track的负载类型
+			if pkt := waitTestPacket(t, stream, packets); pkt.PayloadType != 96 {
+				t.Errorf("PayloadType = %d, want 96", pkt.PayloadType)
+			}
+		})
+	}
+}
+
+func TestRtspServerPaths(t *testing.T) {
+	upstream := NewStreamRegistry()
+	camera := startTestRtspServer(t, upstream)
+	stream := publishTestStream(t, upstream, "cam1")
+
+	sources := NewSourceManager()
+	sources.linger = 100 * time.Millisecond
+	defer sources.Close()
+
+	address := freeAddress(t)
+	listener, err := startRtspListener(NewStreamRegistry(), sources, map[string]string{"front": camera + "/cam1"}, nil, RtspListenConfig{Address: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.close() }()
+
+	// 两个读者共用一个拉流
+	first, _, packets, err := playTestRtsp(t, "rtsp://"+address+"/front")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, _, err := playTestRtsp(t, "rtsp://"+address+"/front")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sourceCount(sources); got != 1 {
+		t.Errorf("sources = %d, want 1", got)
+	}
+	waitTestPacket(t, stream, packets)
+
+	if _, _, _, err = playTestRtsp(t, "rtsp://"+address+"/back"); err == nil {
+		t.Error("unconfigured path should fail")
+	}
+
+	// 还有读者时不断开
+	_ = first.Close()
+	time.Sleep(3 * sources.linger)
+	if got := sourceCount(sources); got != 1 {
+		t.Fatalf("sources with one reader = %d, want 1", got)
+	}
+
+	// 最后一个读者离开后路径和拉流依次关闭
+	_ = second.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for sourceCount(sources) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("source is not closed after the last reader left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	listener.mutex.Lock()
+	paths := len(listener.paths)
+	listener.mutex.Unlock()
+	if paths != 0 {
+		t.Errorf("paths = %d, want 0", paths)
+	}
+}
+
+func TestRtspServerDescribeOnly(t *testing.T) {
+	upstream := NewStreamRegistry()
+	camera := startTestRtspServer(t, upstream)
+	publishTestStream(t, upstream, "cam1")
+
+	sources := NewSourceManager()
+	sources.linger = 50 * time.Millisecond
+	defer sources.Close()
+
+	listener, err := startRtspListener(NewStreamRegistry(), sources, map[string]string{"front": camera + "/cam1"}, nil, RtspListenConfig{Address: freeAddress(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.close() }()
+
+	// 只DESCRIBE不PLAY, 路径也会关闭
+	p, err := listener.path("front")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.subscriber.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("path without reader is not closed")
+	}
+
+	if _, err = listener.path("back"); !errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("path(back) error = %v, want ErrStreamNotFound", err)
+	}
+}
+
+func TestRtspServerPublish(t *testing.T) {
+	streams := NewStreamRegistry()
+	server := startTestRtspServer(t, streams)
+
+	// ANNOUNCE/RECORD推流, 第二个track不支持webrtc, 只转发给rtsp读者
+	publisher := &gortsplib.Client{}
+	tracks := gortsplib.Tracks{
+		&gortsplib.TrackH264{PayloadType: 96},
+		&gortsplib.TrackH265{PayloadType: 97},
+	}
+	if err := publisher.StartPublishing(server+"/desktop", tracks); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = publisher.Close() }()
+
+	stream, err := streams.Get("desktop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codecs := stream.Codecs(); len(codecs) != 1 || codecs[0].MimeType != webrtc.MimeTypeH264 {
+		t.Fatalf("Codecs() = %v", codecs)
+	}
+
+	// 同名推流失败
+	second := &gortsplib.Client{}
+	if err = second.StartPublishing(server+"/desktop", gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96}}); err == nil {
+		_ = second.Close()
+		t.Error("second publisher of the same path should fail")
+	}
+
+	// webrtc观看者直接订阅引擎中的流, 不经过rtsp拉流
+	engine := &WebRtcEngine{
+		streams:      streams,
+		sources:      NewSourceManager(),
+		rtspServer:   server,
+		rtspListener: &rtspListener{},
+	}
+	subscriber, _, err := engine.subscribeSource(context.Background(), server+"/desktop", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	if subscriber.Stream() != stream || sourceCount(engine.sources) != 0 {
+		t.Error("subscribeSource() should use the published stream")
+	}
+
+	// 推流者的RTP转发给引擎中的流
+	received := make(chan int, 10)
+	cancel := stream.addReader(func(trackIndex int, pkt *rtp.Packet) {
+		select {
+		case received <- trackIndex:
+		default:
+		}
+	})
+	defer cancel()
+	pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: 1}, Payload: []byte{0x65, 0x88}}
+	if err = publisher.WritePacketRTP(0, pkt, true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case index := <-received:
+		if index != 0 {
+			t.Errorf("track index = %d, want 0", index)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("packet of the publisher is not forwarded")
+	}
+
+	// 推流者断开后流结束
+	_ = publisher.Close()
+	select {
+	case <-stream.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("stream is not closed after the publisher left")
+	}
+	if _, err = streams.Get("desktop"); !errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("Get() after the publisher left error = %v", err)
+	}
+}
+
+func TestRemotePaths(t *testing.T) {
+	engine := &WebRtcEngine{
+		rtspServer: "rtsp://127.0.0.1:8554",
+		paths: map[string]string{
+			"cam1":  "rtsp://192.168.1.10/stream1",
+			"local": "rtsp://127.0.0.1:8554/live",
+		},
+	}
+
+	remotes := engine.remotePaths()
+	if len(remotes) != 1 || !strings.HasSuffix(remotes["cam1"], "/stream1") {
+		t.Errorf("remotePaths() = %v", remotes)
+	}
+}
+
+func TestRtspServerAuth(t *testing.T) {
+	streams := NewStreamRegistry()
+	publishTestStream(t, streams, "cam1")
+
+	address := freeAddress(t)
+	listener, err := startRtspListener(streams, NewSourceManager(), nil, nil, RtspListenConfig{Address: address, User: "admin", Pass: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.close() }()
+
+	tests := []struct {
+		name     string
+		userinfo string
+		wantErr  bool
+	}{
+		{name: "no credentials", wantErr: true},
+		{name: "wrong password", userinfo: "admin:wrong@", wantErr: true},
+		{name: "valid", userinfo: "admin:secret@"},
+	}
+
+	for _, tt := range tests {
+		t.Run("play "+tt.name, func(t *testing.T) {
+			_, _, _, err := playTestRtsp(t, "rtsp://"+tt.userinfo+address+"/cam1")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("play error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+
+		t.Run("publish "+tt.name, func(t *testing.T) {
+			publisher := &gortsplib.Client{}
+			err := publisher.StartPublishing("rtsp://"+tt.userinfo+address+"/desktop", gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96}})
+			if err == nil {
+				_ = publisher.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("publish error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRtspServerAllowPublish(t *testing.T) {
+	engine := &WebRtcEngine{
+		rtspServer:     "rtsp://127.0.0.1:8554",
+		allowedSources: []string{"rtsp://127.0.0.1:8554/live/*"},
+		paths:          map[string]string{"live/front": "rtsp://192.168.1.10/stream1"},
+	}
+
+	streams := NewStreamRegistry()
+	address := freeAddress(t)
+	listener, err := startRtspListener(streams, NewSourceManager(), nil, engine.allowPublish, RtspListenConfig{Address: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.close() }()
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "allowed", path: "live/desktop"},
+		{name: "not allowed", path: "other/desktop", wantErr: true},
+		{name: "configured path", path: "live/front", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &gortsplib.Client{}
+			err := publisher.StartPublishing("rtsp://"+address+"/"+tt.path, gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96}})
+			if err == nil {
+				defer func() { _ = publisher.Close() }()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("publish error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if _, err = streams.Get(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("Get() error = %v", err)
+			}
+		})
+	}
+}
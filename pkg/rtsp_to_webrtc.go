@@ -2,65 +2,158 @@ package pkg
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/pion/webrtc/v3/pkg/media"
-	"io"
 	"log"
-	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aler9/gortsplib"
-	"github.com/aler9/gortsplib/pkg/url"
 	"github.com/gin-gonic/gin"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
 // 拉流
 
 func (tis *WebRtcEngine) RtspToWebrtc(c *gin.Context) {
+	source, err := tis.resolveSource(c.Query("stream"))
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(sourceErrorStatus(err))
+		return
+	}
+
 	var offer webrtc.SessionDescription
-	if err := c.ShouldBindJSON(&offer); err != nil {
+	if err = c.ShouldBindJSON(&offer); err != nil {
 		log.Println(err)
 		c.Abort()
 		return
 	}
 
-	peerConnection, err := tis.api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	})
+	// 同一rtsp地址的观看者共享一个rtsp会话
+	subscriber, backchannel, err := tis.subscribeSource(c.Request.Context(), source, c.Query("backchannel") != "")
 	if err != nil {
 		log.Println(err)
-		c.Abort()
+		c.AbortWithStatus(playErrorStatus(err))
 		return
 	}
 
-	var videoTrack *webrtc.TrackLocalStaticRTP
-
-	// Create a video track
-	videoTrack, err = webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{
-			MimeType: MimeType,
-		},
-		"pion-rtsp-video-sample", "pion-rtsp-video-stream-sample",
-	)
-	if err != nil {
+	session, err := tis.newPlayerPeerConnection(offer, subscriber, backchannel, nil)
+	if errors.Is(err, ErrNoCommonCodec) {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	} else if err != nil {
 		log.Println(err)
 		c.Abort()
 		return
 	}
 
-	{
-		rtpSender, err := peerConnection.AddTrack(videoTrack)
+	data, _ := json.MarshalIndent(session.pc.LocalDescription(), "", "  ")
+	log.Println(string(data))
+	c.Header(sessionIDHeader, session.ID)
+	c.JSON(http.StatusOK, session.pc.LocalDescription())
+
+	log.Printf("==== havePeerConnection")
+}
+
+// subscribeSource 订阅rtsp地址, backchannel为true时同时占用摄像头的backchannel, 请求结束 (ctx) 时停止等待连接
+// 内置rtsp服务器上的流 (rtsp推流, webrtc推流) 直接订阅, 不再通过rtsp拉流
+func (tis *WebRtcEngine) subscribeSource(ctx context.Context, source string, backchannel bool) (*Subscriber, *Backchannel, error) {
+	if !backchannel && tis.servesLocally(source) {
+		if stream, err := tis.streams.Get(streamName(source)); err == nil {
+			subscriber, err := stream.Subscribe()
+			return subscriber, nil, err
+		}
+	}
+
+	if backchannel {
+		return tis.sources.SubscribeBackchannel(ctx, source)
+	}
+
+	subscriber, err := tis.sources.Subscribe(ctx, source)
+	return subscriber, nil, err
+}
+
+// ErrInvalidOffer 浏览器的offer无法设置或应答
+var ErrInvalidOffer = errors.New("invalid offer")
+
+// answerErrorStatus 创建PeerConnection及answer错误对应的http状态码, 不是offer导致的错误为服务器内部错误
+func answerErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNoCommonCodec):
+		return http.StatusNotAcceptable
+	case errors.Is(err, ErrInvalidOffer):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// playErrorStatus 订阅rtsp地址错误对应的http状态码
+func playErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNoCommonCodec), errors.Is(err, ErrNoBackchannel):
+		return http.StatusNotAcceptable
+	case errors.Is(err, ErrBackchannelBusy):
+		return http.StatusConflict
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// newPlayerPeerConnection 创建拉流播放的PeerConnection, 发送订阅者的track
+// PeerConnection断开后取消订阅, 失败时也会取消订阅
+// backchannel不为nil时, 浏览器发送的音频转发到摄像头
+// onCandidate为nil时返回前等待ICE收集完成; 否则立即返回, candidate通过onCandidate发送
+func (tis *WebRtcEngine) newPlayerPeerConnection(offer webrtc.SessionDescription, subscriber *Subscriber, backchannel *Backchannel, onCandidate func(*webrtc.ICECandidate)) (*Session, error) {
+	// 检查观看者是否支持流的编码
+	offered := sdpMimeTypes(offer.SDP)
+	var codecs []string
+	for _, track := range subscriber.Tracks {
+		codecs = append(codecs, track.Codec().MimeType)
+	}
+	if !func() bool {
+		for _, codec := range codecs {
+			if offered[strings.ToLower(codec)] {
+				return true
+			}
+		}
+		return false
+	}() {
+		subscriber.Close()
+		return nil, fmt.Errorf("%w: stream %v is not in the offer", ErrNoCommonCodec, codecs)
+	}
+	if backchannel != nil && !offered[strings.ToLower(backchannel.Codec.MimeType)] {
+		subscriber.Close()
+		return nil, fmt.Errorf("%w: backchannel %v is not in the offer", ErrNoCommonCodec, backchannel.Codec.MimeType)
+	}
+
+	peerConnection, err := tis.api.NewPeerConnection(tis.configuration())
+	if err != nil {
+		subscriber.Close()
+		return nil, err
+	}
+
+	// 断开后取消订阅; rtsp会话结束后断开
+	watchSubscriber(peerConnection, subscriber)
+
+	for _, track := range subscriber.Tracks {
+		// 观看者未请求的编码 (如没有音频) 不发送
+		if !offered[strings.ToLower(track.Codec().MimeType)] {
+			continue
+		}
+
+		rtpSender, err := peerConnection.AddTrack(track)
 		if err != nil {
-			log.Println(err)
-			c.Abort()
-			return
+			_ = peerConnection.Close()
+			return nil, err
 		}
 
 		// Read incoming RTCP packets
@@ -76,29 +169,20 @@ func (tis *WebRtcEngine) RtspToWebrtc(c *gin.Context) {
 		}()
 	}
 
-	// Set the handler for ICE connection state
-	// This will notify you when the peer has connected/disconnected
-	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		log.Printf("[ice state] Connection State has changed %s \n", connectionState.String())
-
-		if connectionState == webrtc.ICEConnectionStateFailed {
-			if closeErr := peerConnection.Close(); closeErr != nil {
-				log.Println(closeErr)
-			}
+	if backchannel != nil {
+		if err = receiveBackchannel(peerConnection, backchannel); err != nil {
+			_ = peerConnection.Close()
+			return nil, err
 		}
-	})
+	}
 
-	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate != nil {
-			log.Printf("[ice] OnICECandidate %s \n", candidate.String())
-		}
-	})
+	// ICE失败时断开, trickle ice时发送candidate
+	watchICE(peerConnection, onCandidate)
 
 	// Set the remote SessionDescription
 	if err = peerConnection.SetRemoteDescription(offer); err != nil {
-		log.Println(err)
-		c.Abort()
-		return
+		_ = peerConnection.Close()
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOffer, err)
 	}
 
 	// Create channel that is blocked until ICE Gathering is complete
@@ -107,108 +191,99 @@ func (tis *WebRtcEngine) RtspToWebrtc(c *gin.Context) {
 	// Create answer
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
-		log.Println(err)
-		c.Abort()
-		return
+		_ = peerConnection.Close()
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOffer, err)
 	}
 	if err = peerConnection.SetLocalDescription(answer); err != nil {
-		log.Println(err)
-		c.Abort()
-		return
+		_ = peerConnection.Close()
+		return nil, err
 	}
 
-	log.Println("wait PeerConnection complete")
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
+	// 取消订阅后移除会话
+	session := tis.sessions.add(SessionPlay, subscriber.Stream(), peerConnection, subscriber.Done())
 
-	data, _ := json.MarshalIndent(peerConnection.LocalDescription(), "", "  ")
-	log.Println(string(data))
-	c.JSON(http.StatusOK, peerConnection.LocalDescription())
+	if onCandidate == nil {
+		log.Println("wait PeerConnection complete")
+		// Block until ICE Gathering is complete, disabling trickle ICE
+		// we do this because we only can exchange one signaling message
+		<-gatherComplete
+	}
 
-	log.Printf("==== havePeerConnection")
-	// go RtspConsumerRTP(RtspURL, peerConnection, videoTrack)
-	go Rtp(5004, peerConnection, videoTrack)
+	return session, nil
 }
 
-// RtspConsumerRTP rtsp转webrtc RTP
+// RtspConsumerRTP rtsp转webrtc RTP, 转发与videoTrack编码相同的track, 阻塞到PeerConnection断开或rtsp会话结束
+//
+// Deprecated: 使用 SourceManager.Subscribe 订阅rtsp地址, 将 Subscriber.Tracks 加入PeerConnection.
+// 同一rtsp地址的调用共享一个rtsp会话.
 func RtspConsumerRTP(rtspURL string, pc *webrtc.PeerConnection, videoTrack *webrtc.TrackLocalStaticRTP) {
-	// parse URL
-	u, err := url.Parse(rtspURL)
+	sub, err := defaultSources.Subscribe(context.Background(), rtspURL)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	defer sub.Close()
 
-	c := gortsplib.Client{}
-
-	// connect to the server
-	if err = c.Start(u.Scheme, u.Host); err != nil {
-		log.Println(err)
+	index := -1
+	for i, codec := range sub.Stream().Codecs() {
+		if strings.EqualFold(codec.MimeType, videoTrack.Codec().MimeType) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		log.Printf("[rtsp] %v track not found", videoTrack.Codec().MimeType)
 		return
 	}
-	defer func() {
-		_ = c.Close()
-	}()
 
-	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		if state == webrtc.PeerConnectionStateDisconnected {
-			log.Println("close rtsp")
-			_ = c.Close()
+	cancel := sub.Stream().addReader(func(trackIndex int, pkt *rtp.Packet) {
+		if trackIndex != index {
+			return
 		}
-		if state == webrtc.PeerConnectionStateClosed {
-			log.Println("close rtsp")
-			_ = c.Close()
+		if err := videoTrack.WriteRTP(pkt); err != nil {
+			log.Println(err)
 		}
 	})
+	defer cancel()
 
-	// find published tracks
-	tracks, baseURL, _, err := c.Describe(u)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	for _, track := range tracks {
-		log.Printf("track %#v", track)
-	}
-
-	// called when a RTP packet arrives
-	c.OnPacketRTP = func(ctx *gortsplib.ClientOnPacketRTPCtx) {
-		pkt := ctx.Packet
-
-		// log.Println(pkt.Header.SequenceNumber)
-		if err = videoTrack.WriteRTP(pkt); err != nil {
-			log.Println(err)
+	closed := make(chan struct{})
+	var closeOnce sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			closeOnce.Do(func() { close(closed) })
 		}
+	})
+
+	select {
+	case <-closed:
+		log.Println("close rtsp")
+	case <-sub.Stream().Done():
 	}
+}
 
-	log.Println("[rtsp] setup and play")
+// RtspConsumerSample rtsp转webrtc H264, 使用默认的rtsp参数
+func RtspConsumerSample(rtspURL string, pc *webrtc.PeerConnection, videoTrack *webrtc.TrackLocalStaticSample) {
+	defaultSources.ConsumeSample(rtspURL, pc, videoTrack)
+}
 
-	// setup and read all tracks
-	if err = c.SetupAndPlay(tracks, baseURL); err != nil {
-		log.Println(err)
-	}
+// ConsumeSample rtsp转webrtc H264, 使用rtspURL对应的rtsp参数 (WithRtspConfig, WithSourceRtspConfig), 阻塞到rtsp断开
+func (tis *SourceManager) ConsumeSample(rtspURL string, pc *webrtc.PeerConnection, videoTrack *webrtc.TrackLocalStaticSample) {
+	config := tis.clientConfig(rtspURL)
 
-	log.Println("[rtsp] wait...")
-	// wait until a fatal error
-	if err = c.Wait(); err != nil {
+	// parse URL, 加上配置的用户名密码
+	u, err := config.url(rtspURL)
+	if err != nil {
 		log.Println(err)
+		return
 	}
-}
 
-// RtspConsumerSample rtsp转webrtc H264
-func RtspConsumerSample(rtspURL string, pc *webrtc.PeerConnection, videoTrack *webrtc.TrackLocalStaticSample) {
-	// parse URL
-	u, err := url.Parse(rtspURL)
+	c, err := config.newClient()
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	c := gortsplib.Client{}
-
 	// connect to the server
 	if err = c.Start(u.Scheme, u.Host); err != nil {
 		log.Println(err)
@@ -237,7 +312,7 @@ func RtspConsumerSample(rtspURL string, pc *webrtc.PeerConnection, videoTrack *w
 	}
 
 	for _, track := range tracks {
-		log.Printf("track %#v", track)
+		log.Printf("[rtsp] track %v %v", track.GetControl(), trackName(track))
 	}
 
 	// find the H264 track
@@ -306,40 +381,3 @@ func RtspConsumerSample(rtspURL string, pc *webrtc.PeerConnection, videoTrack *w
 		log.Println(err)
 	}
 }
-
-// Rtp rtp转webrtc H264
-// ffmpeg -re -f lavfi -i testsrc=size=640x480:rate=30 -pix_fmt yuv420p -c:v libx264 -g 10 -preset ultrafast -tune zerolatency -f rtp rtp://127.0.0.1:5004?pkt_size=1200
-// ffmpeg -re -i input.mp4 -an -pix_fmt yuv420p -c:v libx264 -g 0.01 -f rtp rtp://127.0.0.1:5004?pkt_size=1200
-// ffmpeg -re -i input.mp4 -an -pix_fmt yuv420p -c:v libx264 -g 0.01 -preset ultrafast -tune zerolatency -f rtp rtp://127.0.0.1:5004?pkt_size=1200
-func Rtp(udpPort int, _ *webrtc.PeerConnection, videoTrack *webrtc.TrackLocalStaticRTP) {
-	// Open a UDP Listener for RTP Packets on port 5004
-	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: udpPort})
-	if err != nil {
-		panic(err)
-	}
-	defer func() {
-		if err = listener.Close(); err != nil {
-			panic(err)
-		}
-	}()
-
-	// Read RTP packets forever and send them to the WebRTC Client
-	inboundRTPPacket := make([]byte, 1600) // UDP MTU
-	for {
-		n, _, err := listener.ReadFrom(inboundRTPPacket)
-		if err != nil {
-			log.Println(err)
-			break
-		}
-
-		if _, err = videoTrack.Write(inboundRTPPacket[:n]); err != nil {
-			if errors.Is(err, io.ErrClosedPipe) {
-				// The peerConnection has been closed.
-				return
-			}
-
-			log.Println(err)
-			break
-		}
-	}
-}
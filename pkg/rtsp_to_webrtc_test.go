@@ -0,0 +1,167 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// writeTestRTP 持续向流的每个track发送RTP直到测试结束
+func writeTestRTP(t *testing.T, stream *Stream) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for i := range stream.Codecs() {
+					stream.WriteRTP(i, &rtp.Packet{
+						Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: uint32(seq) * 1800, SSRC: uint32(i + 1), Marker: true},
+						Payload: []byte{0x65, 0x88, 0x84},
+					})
+				}
+			}
+		}
+	}()
+}
+
+// answerPayloadType answer中编码的payload type
+func answerPayloadType(t *testing.T, answer string, mimeType string) uint8 {
+	t.Helper()
+
+	name := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(mimeType, "video/"), "audio/"))
+	for _, line := range strings.Split(answer, "\r\n") {
+		var payloadType uint8
+		var rtpmap string
+		if _, err := fmt.Sscanf(line, "a=rtpmap:%d %s", &payloadType, &rtpmap); err == nil &&
+			strings.HasPrefix(strings.ToLower(rtpmap), name+"/") {
+			return payloadType
+		}
+	}
+	t.Fatalf("%s is not in the answer:\n%s", mimeType, answer)
+	return 0
+}
+
+func TestPlayAudio(t *testing.T) {
+	tests := []struct {
+		name      string
+		audio     webrtc.RTPCodecCapability
+		recvAudio bool // 观看者接收音频
+	}{
+		{"opus", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, true},
+		{"pcmu", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, true},
+		{"pcma", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, true},
+		{"video only viewer", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, false},
+	}
+
+	gin.SetMode(gin.TestMode)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 摄像头: H264视频 + 音频
+			upstream := NewStreamRegistry()
+			server := startTestRtspServer(t, upstream)
+			stream, err := upstream.Publish("cam1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream.AddTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000})
+			stream.AddTrack(tt.audio)
+			stream.Ready()
+			t.Cleanup(stream.Close)
+			writeTestRTP(t, stream)
+
+			engine, err := NewWebRtcEngine(WithListenAddress("127.0.0.1:0"), WithRtspServer(server))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = engine.Close() }()
+			engine.sessions.onEvent = nil
+
+			r := gin.New()
+			r.POST("/whep", engine.WhepOffer)
+
+			viewer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = viewer.Close() }()
+			kinds := []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo}
+			if tt.recvAudio {
+				kinds = append(kinds, webrtc.RTPCodecTypeAudio)
+			}
+			for _, kind := range kinds {
+				if _, err = viewer.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 静态payload type 0 (PCMU) 的TrackRemote.Codec()为空, 使用包的payload type
+			received := make(chan *rtp.Packet, 2)
+			viewer.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+				if pkt, _, err := remote.ReadRTP(); err == nil {
+					received <- pkt
+				}
+			})
+
+			offer, err := viewer.CreateOffer(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gatherComplete := webrtc.GatheringCompletePromise(viewer)
+			if err = viewer.SetLocalDescription(offer); err != nil {
+				t.Fatal(err)
+			}
+			<-gatherComplete
+
+			req := httptest.NewRequest(http.MethodPost, "/whep?stream=cam1", strings.NewReader(viewer.LocalDescription().SDP))
+			req.Header.Set("Content-Type", "application/sdp")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("POST /whep status = %d", w.Code)
+			}
+			answer, _ := io.ReadAll(w.Body)
+			if err = viewer.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+				t.Fatal(err)
+			}
+
+			// 音频与视频分别在各自的track上收到, payload type为answer中的编码
+			want := map[uint8]string{answerPayloadType(t, string(answer), webrtc.MimeTypeH264): webrtc.MimeTypeH264}
+			if tt.recvAudio {
+				want[answerPayloadType(t, string(answer), tt.audio.MimeType)] = tt.audio.MimeType
+			}
+			got := map[uint8]string{}
+			for len(got) < len(want) {
+				select {
+				case pkt := <-received:
+					codec, ok := want[pkt.PayloadType]
+					if !ok {
+						t.Fatalf("received payload type %d, want %v", pkt.PayloadType, want)
+					}
+					got[pkt.PayloadType] = codec
+				case <-time.After(5 * time.Second):
+					t.Fatalf("received %v, want %v", got, want)
+				}
+			}
+
+			// 观看者没有请求音频时不发送音频track
+			if !tt.recvAudio && strings.Contains(string(answer), "m=audio") {
+				t.Errorf("answer has audio:\n%s", answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// webrtc会话管理
+// GET    /sessions      所有会话
+// GET    /sessions/:id  会话详情
+// DELETE /sessions/:id  断开会话
+
+const (
+	// sessionIDHeader http应答中的会话ID
+	sessionIDHeader = "X-Session-Id"
+
+	// SessionPlay 拉流播放
+	SessionPlay = "play"
+	// SessionPublish 推流
+	SessionPublish = "publish"
+
+	// SessionEventStarted 会话建立
+	SessionEventStarted = "started"
+	// SessionEventClosed 会话结束, Reason为结束原因
+	SessionEventClosed = "closed"
+)
+
+// ErrSessionNotFound 会话不存在
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionEvent 会话建立/结束
+type SessionEvent struct {
+	Type   string    `json:"type"`
+	ID     string    `json:"id"`
+	Kind   string    `json:"kind"`
+	Stream string    `json:"stream"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// WithSessionEvents 会话建立/结束时调用handler, 默认写日志
+func WithSessionEvents(handler func(SessionEvent)) Option {
+	return func(tis *WebRtcEngine) {
+		tis.sessions.onEvent = handler
+	}
+}
+
+// SessionManager 所有PeerConnection, 断开后自动移除
+type SessionManager struct {
+	mutex    sync.Mutex
+	sessions map[string]*Session
+	onEvent  func(SessionEvent)
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: map[string]*Session{},
+		onEvent:  logSessionEvent,
+	}
+}
+
+// logSessionEvent 默认的事件处理
+func logSessionEvent(event SessionEvent) {
+	if event.Reason != "" {
+		log.Printf("[session] %v %v %v %v: %v", event.ID, event.Kind, event.Stream, event.Type, event.Reason)
+	} else {
+		log.Printf("[session] %v %v %v %v", event.ID, event.Kind, event.Stream, event.Type)
+	}
+}
+
+// emit 发送事件
+func (tis *SessionManager) emit(eventType string, session *Session) {
+	if tis.onEvent == nil {
+		return
+	}
+
+	tis.onEvent(SessionEvent{
+		Type:   eventType,
+		ID:     session.ID,
+		Kind:   session.Kind,
+		Stream: session.Stream,
+		Reason: session.Reason(),
+		Time:   time.Now(),
+	})
+}
+
+// add 登记会话, done关闭后移除
+func (tis *SessionManager) add(kind string, stream *Stream, pc *webrtc.PeerConnection, done <-chan struct{}) *Session {
+	session := &Session{
+		ID:        newResourceID(),
+		Kind:      kind,
+		Stream:    stream.Name(),
+		CreatedAt: time.Now(),
+		pc:        pc,
+		source:    stream,
+		done:      make(chan struct{}),
+	}
+
+	tis.mutex.Lock()
+	tis.sessions[session.ID] = session
+	tis.mutex.Unlock()
+
+	tis.emit(SessionEventStarted, session)
+
+	go func() {
+		<-done
+		tis.remove(session)
+	}()
+
+	return session
+}
+
+func (tis *SessionManager) remove(session *Session) {
+	tis.mutex.Lock()
+	if tis.sessions[session.ID] == session {
+		delete(tis.sessions, session.ID)
+	}
+	tis.mutex.Unlock()
+
+	session.closeOnce.Do(func() {
+		// 没有记录原因时使用连接状态, 如 closed, failed
+		session.setReason(session.pc.ConnectionState().String())
+		tis.emit(SessionEventClosed, session)
+		close(session.done)
+	})
+}
+
+// Get 获取会话
+func (tis *SessionManager) Get(id string) (*Session, error) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	session, ok := tis.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	return session, nil
+}
+
+// List 所有会话, 按创建时间排序
+func (tis *SessionManager) List() []*Session {
+	tis.mutex.Lock()
+	result := make([]*Session, 0, len(tis.sessions))
+	for _, session := range tis.sessions {
+		result = append(result, session)
+	}
+	tis.mutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result
+}
+
+// Close 向所有会话发送BYE并断开
+func (tis *SessionManager) Close() {
+	for _, session := range tis.List() {
+		session.bye("shutdown")
+		session.end("shutdown")
+	}
+}
+
+// Wait 等待所有会话移除
+func (tis *SessionManager) Wait() {
+	for _, session := range tis.List() {
+		<-session.Done()
+	}
+}
+
+// Session 一个PeerConnection
+type Session struct {
+	ID        string
+	Kind      string
+	Stream    string
+	CreatedAt time.Time
+
+	pc        *webrtc.PeerConnection
+	source    *Stream
+	closeOnce sync.Once
+	done      chan struct{}
+
+	mutex  sync.Mutex
+	reason string
+	etag   string // WHIP资源的ETag, ICE restart后更新
+
+	// negotiation WHIP trickle ice / ice restart 依次处理
+	negotiation sync.Mutex
+}
+
+// PeerConnection 会话的PeerConnection
+func (tis *Session) PeerConnection() *webrtc.PeerConnection {
+	return tis.pc
+}
+
+// Close 断开会话, 断开后自动移除
+func (tis *Session) Close() error {
+	return tis.pc.Close()
+}
+
+// end 记录结束原因并断开会话, 只影响这一个会话
+func (tis *Session) end(reason string) {
+	tis.setReason(reason)
+	if err := tis.pc.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+// setReason 记录第一个结束原因
+func (tis *Session) setReason(reason string) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.reason == "" {
+		tis.reason = reason
+	}
+}
+
+// Reason 会话结束原因, 未结束时为空
+func (tis *Session) Reason() string {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return tis.reason
+}
+
+// bye 发送RTCP BYE, 通知对端发送的track结束
+func (tis *Session) bye(reason string) {
+	var sources []uint32
+	for _, sender := range tis.pc.GetSenders() {
+		for _, encoding := range sender.GetParameters().Encodings {
+			if encoding.SSRC != 0 {
+				sources = append(sources, uint32(encoding.SSRC))
+			}
+		}
+	}
+	if len(sources) == 0 {
+		return
+	}
+
+	if err := tis.pc.WriteRTCP([]rtcp.Packet{&rtcp.Goodbye{Sources: sources, Reason: reason}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// SourceState 流来源的状态, 以及状态改变时关闭的channel
+func (tis *Session) SourceState() (SourceState, <-chan struct{}) {
+	return tis.source.State()
+}
+
+// Done 会话移除后关闭
+func (tis *Session) Done() <-chan struct{} {
+	return tis.done
+}
+
+// SessionInfo 会话状态
+type SessionInfo struct {
+	ID            string    `json:"id"`
+	Kind          string    `json:"kind"`
+	Stream        string    `json:"stream"`
+	State         string    `json:"state"`
+	ICEState      string    `json:"iceState"`
+	RemoteAddress string    `json:"remoteAddress,omitempty"`
+	BytesSent     uint64    `json:"bytesSent"`
+	BytesReceived uint64    `json:"bytesReceived"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Duration      string    `json:"duration"`
+	Reason        string    `json:"reason,omitempty"`
+	SourceState   string    `json:"sourceState,omitempty"`
+}
+
+// Info 会话状态
+func (tis *Session) Info() SessionInfo {
+	info := SessionInfo{
+		ID:        tis.ID,
+		Kind:      tis.Kind,
+		Stream:    tis.Stream,
+		State:     tis.pc.ConnectionState().String(),
+		ICEState:  tis.pc.ICEConnectionState().String(),
+		CreatedAt: tis.CreatedAt,
+		Duration:  time.Since(tis.CreatedAt).Round(time.Second).String(),
+		Reason:    tis.Reason(),
+	}
+	state, _ := tis.SourceState()
+	info.SourceState = state.State
+
+	// 选中的candidate对
+	if pair, err := tis.pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+		info.RemoteAddress = net.JoinHostPort(pair.Remote.Address, strconv.Itoa(int(pair.Remote.Port)))
+	}
+
+	if stats, ok := tis.pc.GetStats()["iceTransport"].(webrtc.TransportStats); ok {
+		info.BytesSent = stats.BytesSent
+		info.BytesReceived = stats.BytesReceived
+	}
+
+	return info
+}
+
+// SessionList 所有会话
+func (tis *WebRtcEngine) SessionList(c *gin.Context) {
+	var result []SessionInfo
+	for _, session := range tis.sessions.List() {
+		result = append(result, session.Info())
+	}
+	if result == nil {
+		result = []SessionInfo{}
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// SessionGet 会话详情
+func (tis *WebRtcEngine) SessionGet(c *gin.Context) {
+	session, err := tis.sessions.Get(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, session.Info())
+}
+
+// SessionDelete 断开会话
+func (tis *WebRtcEngine) SessionDelete(c *gin.Context) {
+	session, err := tis.sessions.Get(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	session.end("deleted")
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v3"
+)
+
+// addTestSession 登记一个会话, PeerConnection关闭后移除
+func addTestSession(t *testing.T, engine *WebRtcEngine, kind string, stream *Stream) *Session {
+	t.Helper()
+
+	pc, err := engine.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	done := make(chan struct{})
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed {
+			once.Do(func() { close(done) })
+		}
+	})
+	return engine.sessions.add(kind, stream, pc, done)
+}
+
+func TestSessionAPI(t *testing.T) {
+	var (
+		mutex  sync.Mutex
+		events []SessionEvent
+	)
+	engine, err := NewWebRtcEngine(WithListenAddress("127.0.0.1:0"), WithSessionEvents(func(event SessionEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, event)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = engine.Close() }()
+
+	stream, err := engine.streams.Publish("live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	player := addTestSession(t, engine, SessionPlay, stream)
+	time.Sleep(10 * time.Millisecond)
+	publisher := addTestSession(t, engine, SessionPublish, stream)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/sessions", engine.SessionList)
+	r.GET("/sessions/:id", engine.SessionGet)
+	r.DELETE("/sessions/:id", engine.SessionDelete)
+
+	do := func(method string, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	// 按创建时间排序
+	w := do(http.MethodGet, "/sessions")
+	var list []SessionInfo
+	if err = json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET /sessions = %d %s", w.Code, w.Body)
+	}
+	if len(list) != 2 || list[0].ID != player.ID || list[1].ID != publisher.ID {
+		t.Fatalf("GET /sessions = %+v", list)
+	}
+	if list[0].Kind != SessionPlay || list[0].Stream != "live" || list[0].State != webrtc.PeerConnectionStateNew.String() {
+		t.Errorf("session info = %+v", list[0])
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		id     string
+		status int
+	}{
+		{"get", http.MethodGet, player.ID, http.StatusOK},
+		{"get unknown", http.MethodGet, "unknown", http.StatusNotFound},
+		{"delete unknown", http.MethodDelete, "unknown", http.StatusNotFound},
+		{"delete", http.MethodDelete, player.ID, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(tt.method, "/sessions/"+tt.id)
+			if w.Code != tt.status {
+				t.Fatalf("%s /sessions/%s status = %d, want %d", tt.method, tt.id, w.Code, tt.status)
+			}
+
+			if tt.method == http.MethodGet && tt.status == http.StatusOK {
+				var info SessionInfo
+				if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || info.ID != tt.id {
+					t.Errorf("session info = %s", w.Body)
+				}
+			}
+		})
+	}
+
+	// DELETE 只断开这一个会话, 之后自动移除
+	select {
+	case <-player.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("deleted session is not removed")
+	}
+	if reason := player.Reason(); reason != "deleted" {
+		t.Errorf("Reason() = %q, want deleted", reason)
+	}
+	if w = do(http.MethodGet, "/sessions/"+player.ID); w.Code != http.StatusNotFound {
+		t.Errorf("GET deleted session status = %d", w.Code)
+	}
+	if w = do(http.MethodDelete, "/sessions/"+player.ID); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE deleted session status = %d", w.Code)
+	}
+	if sessions := engine.sessions.List(); len(sessions) != 1 || sessions[0] != publisher {
+		t.Errorf("List() = %v, want the publisher only", sessions)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []string{SessionEventStarted, SessionEventStarted, SessionEventClosed}
+	if len(events) != len(want) {
+		t.Fatalf("events = %+v", events)
+	}
+	for i, event := range events {
+		if event.Type != want[i] {
+			t.Errorf("event %d = %+v, want %s", i, event, want[i])
+		}
+	}
+	if last := events[2]; last.ID != player.ID || last.Reason != "deleted" {
+		t.Errorf("closed event = %+v", last)
+	}
+}
@@ -0,0 +1,295 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// websocket信令, trickle ice
+// GET /signaling?mode=play|publish|get&stream=xxx&backchannel=1
+// 客户端 -> {"type":"offer","sdp":"..."}, {"type":"candidate","candidate":{...}}
+// 服务端 -> {"type":"answer","sdp":"...","session":"id"}, {"type":"candidate","candidate":{...}}, {"type":"error","error":"..."}, {"type":"state","state":{...}}, {"type":"bye","reason":"..."}
+// candidate为空表示收集完成; websocket断开后结束会话, 会话结束后发送bye并断开websocket
+
+const (
+	signalOffer     = "offer"
+	signalAnswer    = "answer"
+	signalCandidate = "candidate"
+	signalError     = "error"
+	signalBye       = "bye"
+	signalState     = "state"
+)
+
+// signalMessage websocket信令消息
+type signalMessage struct {
+	Type      string                   `json:"type"`
+	SDP       string                   `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+	Error     string                   `json:"error,omitempty"`
+	Session   string                   `json:"session,omitempty"`
+	Reason    string                   `json:"reason,omitempty"`
+	State     *SourceState             `json:"state,omitempty"`
+}
+
+// WithAllowedOrigins websocket信令允许的跨站Origin, 如 https://example.com, * 允许所有
+// 默认只允许与请求Host相同的Origin, 防止其它网站借用浏览器的认证信息连接信令
+func WithAllowedOrigins(origins ...string) Option {
+	return func(tis *WebRtcEngine) {
+		tis.allowedOrigins = append(tis.allowedOrigins, origins...)
+	}
+}
+
+// checkOrigin 校验websocket请求的Origin, 没有Origin的非浏览器客户端不校验
+func (tis *WebRtcEngine) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range tis.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	log.Printf("[signaling] origin %v not allowed", origin)
+	return false
+}
+
+// signalConn 发送信令, answer发送前收集到的candidate先缓存
+type signalConn struct {
+	mutex    sync.Mutex
+	conn     *websocket.Conn
+	answered bool
+	pending  []signalMessage
+}
+
+func (tis *signalConn) write(msg signalMessage) {
+	if err := tis.conn.WriteJSON(msg); err != nil {
+		log.Println(err)
+	}
+}
+
+// sendAnswer 发送answer及缓存的candidate
+func (tis *signalConn) sendAnswer(answer *webrtc.SessionDescription, sessionID string) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.write(signalMessage{Type: signalAnswer, SDP: answer.SDP, Session: sessionID})
+	for _, msg := range tis.pending {
+		tis.write(msg)
+	}
+	tis.answered, tis.pending = true, nil
+}
+
+// sendCandidate 发送本地candidate, nil表示收集完成
+func (tis *signalConn) sendCandidate(candidate *webrtc.ICECandidate) {
+	msg := signalMessage{Type: signalCandidate}
+	if candidate != nil {
+		init := candidate.ToJSON()
+		msg.Candidate = &init
+	}
+
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if !tis.answered {
+		tis.pending = append(tis.pending, msg)
+		return
+	}
+	tis.write(msg)
+}
+
+// sendBye 会话结束及原因
+func (tis *signalConn) sendBye(reason string) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.write(signalMessage{Type: signalBye, Reason: reason})
+}
+
+// sendState 流来源的状态
+func (tis *signalConn) sendState(state SourceState) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.write(signalMessage{Type: signalState, State: &state})
+}
+
+// sendError 发送错误
+func (tis *signalConn) sendError(err error) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.write(signalMessage{Type: signalError, Error: err.Error()})
+}
+
+// Signaling websocket信令, 交换offer/answer并实时交换candidate
+func (tis *WebRtcEngine) Signaling(c *gin.Context) {
+	upgrader := websocket.Upgrader{CheckOrigin: tis.checkOrigin}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	signal := &signalConn{conn: conn}
+
+	var peerConnection *webrtc.PeerConnection
+	defer func() {
+		if peerConnection != nil {
+			_ = peerConnection.Close()
+		}
+	}()
+
+	for {
+		var msg signalMessage
+		if err = conn.ReadJSON(&msg); err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case signalOffer:
+			if peerConnection != nil {
+				signal.sendError(errors.New("offer already received"))
+				continue
+			}
+
+			offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: msg.SDP}
+
+			session, err := tis.signalPeerConnection(c, offer, signal.sendCandidate)
+			if err != nil {
+				log.Println(err)
+				signal.sendError(err)
+				return
+			}
+			peerConnection = session.pc
+			signal.sendAnswer(peerConnection.LocalDescription(), session.ID)
+
+			// 会话结束后断开websocket
+			go func() {
+				<-session.Done()
+				signal.sendBye(session.Reason())
+				_ = conn.Close()
+			}()
+
+			// rtsp来源状态 (连接中, 播放中, 重连中) 改变时通知观看者
+			go func() {
+				for {
+					state, changed := session.SourceState()
+					if state.State != "" {
+						signal.sendState(state)
+					}
+
+					select {
+					case <-changed:
+					case <-session.Done():
+						return
+					}
+				}
+			}()
+
+			log.Printf("==== havePeerConnection (signaling)")
+
+		case signalCandidate:
+			if peerConnection == nil {
+				signal.sendError(errors.New("candidate before offer"))
+				continue
+			}
+			// 收集完成
+			if msg.Candidate == nil {
+				continue
+			}
+			if err = peerConnection.AddICECandidate(*msg.Candidate); err != nil {
+				log.Println(err)
+			}
+
+		default:
+			signal.sendError(fmt.Errorf("unknown message type %q", msg.Type))
+		}
+	}
+}
+
+// signalPeerConnection 按 mode 创建PeerConnection
+func (tis *WebRtcEngine) signalPeerConnection(c *gin.Context, offer webrtc.SessionDescription, onCandidate func(*webrtc.ICECandidate)) (*Session, error) {
+	switch mode := c.DefaultQuery("mode", "play"); mode {
+	case "play":
+		source, err := tis.resolveSource(c.Query("stream"))
+		if err != nil {
+			return nil, err
+		}
+
+		subscriber, backchannel, err := tis.subscribeSource(c.Request.Context(), source, c.Query("backchannel") != "")
+		if err != nil {
+			return nil, err
+		}
+
+		return tis.newPlayerPeerConnection(offer, subscriber, backchannel, onCandidate)
+
+	case "publish":
+		target, err := tis.resolveSource(c.Query("stream"))
+		if err != nil {
+			return nil, err
+		}
+
+		session, _, err := tis.newPublisherPeerConnection(offer, target, onCandidate)
+		return session, err
+
+	case "get":
+		stream, err := tis.streams.Get(streamName(c.Query("stream")))
+		if err != nil {
+			return nil, err
+		}
+
+		subscriber, err := stream.Subscribe()
+		if err != nil {
+			return nil, err
+		}
+
+		return tis.newPlayerPeerConnection(offer, subscriber, nil, onCandidate)
+
+	default:
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+}
+
+// watchICE ICE失败时断开PeerConnection; onCandidate不为nil时发送本地candidate, 收集完成时传入nil
+func watchICE(pc *webrtc.PeerConnection, onCandidate func(*webrtc.ICECandidate)) {
+	// Set the handler for ICE connection state
+	// This will notify you when the peer has connected/disconnected
+	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		log.Printf("[ice state] Connection State has changed %s \n", connectionState.String())
+
+		if connectionState == webrtc.ICEConnectionStateFailed {
+			if closeErr := pc.Close(); closeErr != nil {
+				log.Println(closeErr)
+			}
+		}
+	})
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			log.Printf("[ice] OnICECandidate %s \n", candidate.String())
+		}
+		if onCandidate != nil {
+			onCandidate(candidate)
+		}
+	})
+}
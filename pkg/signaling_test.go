@@ -0,0 +1,266 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{name: "no origin", want: true},
+		{name: "same host", origin: "http://example.com:8080", want: true},
+		{name: "other site", origin: "https://evil.example", want: false},
+		{name: "other port", origin: "http://example.com:9090", want: false},
+		{name: "allowed", origin: "https://app.example", allowed: []string{"https://app.example/"}, want: true},
+		{name: "not in allowlist", origin: "https://evil.example", allowed: []string{"https://app.example"}, want: false},
+		{name: "any", origin: "https://evil.example", allowed: []string{"*"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &WebRtcEngine{allowedOrigins: tt.allowed}
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com:8080/signaling", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if got := engine.checkOrigin(req); got != tt.want {
+				t.Errorf("checkOrigin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignalConnPending(t *testing.T) {
+	candidate := webrtc.ICECandidate{
+		Foundation: "1",
+		Priority:   2122260223,
+		Address:    "192.168.1.2",
+		Protocol:   webrtc.ICEProtocolUDP,
+		Port:       50000,
+		Typ:        webrtc.ICECandidateTypeHost,
+		Component:  1,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		// answer之前收集到的candidate缓存, answer之后依次发送
+		signal := &signalConn{conn: conn}
+		signal.sendCandidate(&candidate)
+		signal.sendAnswer(&webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "answer"}, "id1")
+		signal.sendCandidate(nil)
+
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	want := []string{signalAnswer, signalCandidate, signalCandidate}
+	for i, wantType := range want {
+		var msg signalMessage
+		if err = conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != wantType {
+			t.Fatalf("message %d type = %q, want %q", i, msg.Type, wantType)
+		}
+
+		switch i {
+		case 0:
+			if msg.SDP != "answer" || msg.Session != "id1" {
+				t.Errorf("answer = %+v", msg)
+			}
+		case 1:
+			if msg.Candidate == nil || !strings.Contains(msg.Candidate.Candidate, "192.168.1.2") {
+				t.Errorf("candidate = %+v", msg.Candidate)
+			}
+		case 2:
+			// 收集完成
+			if msg.Candidate != nil {
+				t.Errorf("end of candidates = %+v", msg.Candidate)
+			}
+		}
+	}
+}
+
+// dialTestSignaling 通过websocket信令连接pc, 返回会话ID
+// 本地candidate在offer之后发送, 收到answer之前不应收到candidate
+func dialTestSignaling(t *testing.T, server *httptest.Server, query string, pc *webrtc.PeerConnection) string {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/signaling?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	var mutex sync.Mutex
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		msg := signalMessage{Type: signalCandidate}
+		if candidate != nil {
+			init := candidate.ToJSON()
+			msg.Candidate = &init
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		_ = conn.WriteJSON(msg)
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	if err = pc.SetLocalDescription(offer); err == nil {
+		err = conn.WriteJSON(signalMessage{Type: signalOffer, SDP: offer.SDP})
+	}
+	mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionID := make(chan string, 1)
+	go func() {
+		answered := false
+		for {
+			var msg signalMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+
+			switch msg.Type {
+			case signalAnswer:
+				if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: msg.SDP}); err != nil {
+					t.Error(err)
+				}
+				answered = true
+				sessionID <- msg.Session
+			case signalCandidate:
+				if !answered {
+					t.Error("candidate before answer")
+				} else if msg.Candidate != nil {
+					_ = pc.AddICECandidate(*msg.Candidate)
+				}
+			case signalError:
+				t.Errorf("signaling error: %v", msg.Error)
+				sessionID <- ""
+			}
+		}
+	}()
+
+	select {
+	case id := <-sessionID:
+		return id
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer")
+		return ""
+	}
+}
+
+func TestSignaling(t *testing.T) {
+	address := freeAddress(t)
+	engine, err := NewWebRtcEngine(
+		WithListenAddress(":0"),
+		WithRtspServer("rtsp://"+address),
+		WithRtspListen(RtspListenConfig{Address: address}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = engine.Close() }()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/signaling", engine.Signaling)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// 推流
+	publisher, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = publisher.Close() }()
+	track := newTestVideoTrack(t)
+	if _, err = publisher.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+
+	id := dialTestSignaling(t, server, "mode=publish&stream=desktop", publisher)
+	if session, err := engine.sessions.Get(id); err != nil || session.Kind != SessionPublish {
+		t.Fatalf("publish session = %v, %v", session, err)
+	}
+	writeTestSamples(t, track)
+
+	// 观看引擎中的流
+	viewer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = viewer.Close() }()
+	if _, err = viewer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan webrtc.RTPCodecParameters, 1)
+	viewer.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if _, _, err := remote.ReadRTP(); err == nil {
+			received <- remote.Codec()
+		}
+	})
+
+	id = dialTestSignaling(t, server, "mode=get&stream=desktop", viewer)
+	if session, err := engine.sessions.Get(id); err != nil || session.Kind != SessionPlay {
+		t.Fatalf("play session = %v, %v", session, err)
+	}
+
+	stream, err := engine.streams.Get("desktop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case codec := <-received:
+		// 观看者使用推流协商的编码
+		if want := stream.Codecs()[0].MimeType; codec.MimeType != want {
+			t.Errorf("codec = %v, want %v", codec.MimeType, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("viewer received no packet")
+	}
+
+	// 其它网站的页面不能连接信令
+	header := http.Header{"Origin": []string{"https://evil.example"}}
+	conn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/signaling", header)
+	if err == nil {
+		_ = conn.Close()
+		t.Fatal("cross-site websocket should be rejected")
+	}
+	if res == nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-site response = %v", res)
+	}
+}
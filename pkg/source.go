@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aler9/gortsplib/pkg/url"
+)
+
+// ErrSourceNotAllowed 请求的rtsp地址不在白名单中
+var ErrSourceNotAllowed = errors.New("rtsp source not allowed")
+
+// WithAllowedSources 允许拉流/推流的rtsp地址, 支持通配符 (path.Match), 如 rtsp://192.168.1.*/*
+// 匹配的是去掉用户名密码后的地址; * 不能跨越 /, 以 /** 结尾时匹配剩余的一级或多级路径, 如 rtsp://192.168.1.10/**
+// 默认只允许 rtsp服务器 (WithRtspServer) 下的路径
+func WithAllowedSources(patterns ...string) Option {
+	return func(tis *WebRtcEngine) {
+		tis.allowedSources = append(tis.allowedSources, patterns...)
+	}
+}
+
+// WithRtspServer 流路径对应的rtsp服务器, 默认 RtspServer
+func WithRtspServer(server string) Option {
+	return func(tis *WebRtcEngine) {
+		tis.rtspServer = strings.TrimSuffix(server, "/")
+	}
+}
+
+// WithPaths 流名称对应的rtsp地址, 如 cam1 -> rtsp://192.168.1.10/stream1, 配置的地址不校验白名单
+// 启用内置rtsp服务器时也可以通过 rtsp://host:8554/cam1 读取, 与webrtc观看者共用拉流
+func WithPaths(paths map[string]string) Option {
+	return func(tis *WebRtcEngine) {
+		if tis.paths == nil {
+			tis.paths = map[string]string{}
+		}
+		for name, source := range paths {
+			tis.paths[strings.Trim(name, "/")] = source
+		}
+	}
+}
+
+// resolveSource 将请求的流路径或完整地址转换为rtsp地址, 并校验白名单
+// "" -> rtspServer/live, "cam1" -> paths[cam1] 或 rtspServer/cam1, "rtsp://host/path" -> 原样
+func (tis *WebRtcEngine) resolveSource(stream string) (string, error) {
+	stream = strings.TrimSpace(stream)
+
+	rtspServer := tis.rtspServer
+	if rtspServer == "" {
+		rtspServer = RtspServer
+	}
+
+	var address string
+	switch {
+	case stream == "":
+		address = rtspServer + "/live"
+	case strings.Contains(stream, "://"):
+		address = stream
+	default:
+		p := path.Clean("/" + stream)
+		if p == "/" {
+			return "", fmt.Errorf("invalid stream path '%s'", stream)
+		}
+		if source, ok := tis.paths[strings.TrimPrefix(p, "/")]; ok {
+			return source, nil
+		}
+		address = rtspServer + p
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid rtsp address '%s'", stream)
+	}
+
+	patterns := tis.allowedSources
+	if len(patterns) == 0 {
+		patterns = []string{rtspServer + "/**"}
+	}
+
+	redacted := u.CloneWithoutCredentials().String()
+	for _, pattern := range patterns {
+		if matchSource(pattern, redacted) {
+			return u.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrSourceNotAllowed, redacted)
+}
+
+// matchSource 白名单匹配, 同 path.Match, 另外 pattern 以 /** 结尾时匹配剩余的一级或多级路径
+func matchSource(pattern string, address string) bool {
+	if !strings.HasSuffix(pattern, "/**") {
+		ok, _ := path.Match(pattern, address)
+		return ok
+	}
+
+	prefix := strings.TrimSuffix(pattern, "/**")
+	start := strings.Index(address, "://")
+	if start < 0 {
+		start = 0
+	} else {
+		start += len("://")
+	}
+
+	// 依次尝试用前缀匹配每个 / 之前的部分, / 之后不能为空
+	for i := start; i < len(address)-1; i++ {
+		if address[i] != '/' {
+			continue
+		}
+		if ok, _ := path.Match(prefix, address[:i]); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// servesLocally 内置rtsp服务器启用时, rtspServer下的路径由内置服务器直接提供, 不需要推流到外部服务器
+func (tis *WebRtcEngine) servesLocally(address string) bool {
+	if tis.rtspListener == nil {
+		return false
+	}
+	return tis.isRtspServer(address)
+}
+
+// isRtspServer 地址是否在rtspServer下
+func (tis *WebRtcEngine) isRtspServer(address string) bool {
+	rtspServer := tis.rtspServer
+	if rtspServer == "" {
+		rtspServer = RtspServer
+	}
+	return strings.HasPrefix(address, rtspServer+"/")
+}
+
+// remotePaths 内置rtsp服务器通过拉流提供的配置路径, 指向rtspServer的路径由服务器自身提供, 不再拉流
+func (tis *WebRtcEngine) remotePaths() map[string]string {
+	remotes := map[string]string{}
+	for name, address := range tis.paths {
+		if !tis.isRtspServer(address) {
+			remotes[name] = address
+		}
+	}
+	return remotes
+}
+
+// allowPublish 内置rtsp服务器的推流名称需通过白名单, 配置的路径由拉流提供, 不能推流
+func (tis *WebRtcEngine) allowPublish(name string) error {
+	if _, ok := tis.paths[name]; ok {
+		return fmt.Errorf("%w: %s is a configured path", ErrSourceNotAllowed, name)
+	}
+	_, err := tis.resolveSource(name)
+	return err
+}
+
+// sourceErrorStatus resolveSource 错误对应的http状态码
+func sourceErrorStatus(err error) int {
+	if errors.Is(err, ErrSourceNotAllowed) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
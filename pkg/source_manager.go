@@ -0,0 +1,570 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/url"
+	"github.com/pion/webrtc/v3"
+)
+
+// rtsp拉流共享
+// 同一个rtsp地址只建立一个rtsp会话, 第一个观看者到来时连接, 最后一个观看者离开 linger 后断开
+// 类似 rtsp-simple-server 的 sourceOnDemand / sourceOnDemandCloseAfter
+
+const (
+	// DefaultSourceLinger 最后一个观看者离开后rtsp会话保持的时间
+	DefaultSourceLinger = 10 * time.Second
+
+	// DefaultSourceRetryMin rtsp断开后第一次重连的等待时间, 之后每次翻倍
+	DefaultSourceRetryMin = time.Second
+	// DefaultSourceRetryMax 重连等待时间的上限
+	DefaultSourceRetryMax = 30 * time.Second
+)
+
+// errSourceClosed rtsp会话已停止
+var errSourceClosed = errors.New("rtsp source closed")
+
+// WithSourceLinger 最后一个观看者离开后rtsp会话保持的时间
+func WithSourceLinger(linger time.Duration) Option {
+	return func(tis *WebRtcEngine) {
+		tis.sources.linger = linger
+	}
+}
+
+// WithSourceRetry rtsp断开后的重连等待时间, 从min开始每次翻倍到max, 加随机抖动; min为0时不重连
+func WithSourceRetry(min time.Duration, max time.Duration) Option {
+	return func(tis *WebRtcEngine) {
+		tis.sources.retryMin, tis.sources.retryMax = min, max
+	}
+}
+
+// defaultSources 包级函数 (RtspConsumerRTP) 使用的rtsp拉流管理
+var defaultSources = NewSourceManager()
+
+// SourceManager rtsp拉流管理, 引用计数
+type SourceManager struct {
+	mutex    sync.Mutex
+	linger   time.Duration
+	retryMin time.Duration
+	retryMax time.Duration
+	config   RtspConfig
+	configs  map[string]RtspConfig // rtsp地址 -> 参数
+	streams  *StreamRegistry
+	sources  map[string]*rtspSource
+}
+
+func NewSourceManager() *SourceManager {
+	return &SourceManager{
+		linger:   DefaultSourceLinger,
+		retryMin: DefaultSourceRetryMin,
+		retryMax: DefaultSourceRetryMax,
+		streams:  NewStreamRegistry(),
+		sources:  map[string]*rtspSource{},
+	}
+}
+
+// Subscribe 订阅rtsp地址, 必要时建立rtsp会话; 阻塞到DESCRIBE完成, 连接失败时按退避时间重连, 直到ctx结束
+func (tis *SourceManager) Subscribe(ctx context.Context, address string) (*Subscriber, error) {
+	sub, _, err := tis.subscribe(ctx, address, false)
+	return sub, err
+}
+
+func (tis *SourceManager) subscribe(ctx context.Context, address string, backchannel bool) (*Subscriber, *rtspSource, error) {
+	// 地址错误时不建立会话
+	if _, err := tis.clientConfig(address).url(address); err != nil {
+		return nil, nil, err
+	}
+
+	// 带backchannel的rtsp会话单独建立; 按完整地址区分, 不同用户名密码不共用会话
+	key, name := address, sourceName(address)
+	if backchannel {
+		key += "#backchannel"
+		name += "#backchannel"
+	}
+
+	tis.mutex.Lock()
+	src, ok := tis.sources[key]
+	if !ok {
+		var err error
+		if src, err = tis.start(key, name, address, backchannel); err != nil {
+			tis.mutex.Unlock()
+			return nil, nil, err
+		}
+	}
+	if src.linger != nil {
+		src.linger.Stop()
+		src.linger = nil
+	}
+	src.refs++
+	tis.mutex.Unlock()
+
+	select {
+	case <-src.ready:
+	case <-ctx.Done():
+		tis.release(src)
+		return nil, nil, ctx.Err()
+	}
+	if src.err != nil {
+		tis.release(src)
+		return nil, nil, src.err
+	}
+
+	sub, err := src.stream.Subscribe()
+	if err != nil {
+		tis.release(src)
+		return nil, nil, err
+	}
+	sub.onClose = func() {
+		tis.release(src)
+	}
+
+	return sub, src, nil
+}
+
+// start 建立rtsp会话, name为流名称, 不含密码
+func (tis *SourceManager) start(key string, name string, address string, backchannel bool) (*rtspSource, error) {
+	stream, err := tis.streams.Publish(name)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &rtspSource{
+		manager:            tis,
+		key:                key,
+		address:            address,
+		stream:             stream,
+		ready:              make(chan struct{}),
+		backchannel:        backchannel,
+		backchannelTrackID: -1,
+		terminate:          make(chan struct{}),
+	}
+	tis.sources[key] = src
+
+	go src.run()
+
+	return src, nil
+}
+
+// release 观看者离开, 引用为0时延迟关闭
+func (tis *SourceManager) release(src *rtspSource) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	src.refs--
+	if src.refs > 0 {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(tis.linger, func() {
+		tis.mutex.Lock()
+		if src.refs > 0 || src.linger != timer {
+			tis.mutex.Unlock()
+			return
+		}
+		src.linger = nil
+		tis.remove(src)
+		src.stream.Close()
+		tis.mutex.Unlock()
+
+		log.Printf("[rtsp] no viewer, close %v", src.stream.Name())
+		src.close()
+	})
+	src.linger = timer
+}
+
+// Close 断开所有rtsp会话, 订阅者随之断开
+func (tis *SourceManager) Close() {
+	tis.mutex.Lock()
+	sources := make([]*rtspSource, 0, len(tis.sources))
+	for _, src := range tis.sources {
+		if src.linger != nil {
+			src.linger.Stop()
+			src.linger = nil
+		}
+		sources = append(sources, src)
+	}
+	tis.mutex.Unlock()
+
+	for _, src := range sources {
+		src.stream.Close()
+		src.close()
+	}
+}
+
+// clientConfig rtsp地址使用的参数
+func (tis *SourceManager) clientConfig(address string) RtspConfig {
+	if config, ok := tis.configs[address]; ok {
+		return config
+	}
+	return tis.config
+}
+
+// validate 检查所有rtsp参数
+func (tis *SourceManager) validate() error {
+	if err := tis.config.validate(); err != nil {
+		return err
+	}
+	for _, config := range tis.configs {
+		if err := config.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove 调用时需持有锁
+func (tis *SourceManager) remove(src *rtspSource) {
+	if tis.sources[src.key] == src {
+		delete(tis.sources, src.key)
+	}
+}
+
+// rtspSource 一个rtsp拉流会话, 断开后重连, 观看者继续使用原来的track
+type rtspSource struct {
+	manager *SourceManager
+	key     string
+	address string
+	stream  *Stream
+
+	// ONVIF backchannel
+	backchannel      bool
+	backchannelTrack gortsplib.Track
+	talking          int32
+
+	// 受 manager.mutex 保护
+	refs   int
+	linger *time.Timer
+
+	ready chan struct{} // 第一次DESCRIBE完成或放弃连接后关闭
+	err   error         // 放弃连接的原因
+
+	// 媒体类型 -> 流的track序号, 重连后沿用
+	mediaIndexes map[string]int
+	rewriters    map[int]*rtpRewriter
+
+	mutex              sync.Mutex
+	client             *gortsplib.Client
+	playing            bool
+	backchannelTrackID int
+
+	terminate     chan struct{}
+	terminateOnce sync.Once
+}
+
+// run rtsp转webrtc RTP, 断开后按退避时间重连
+func (tis *rtspSource) run() {
+	defer func() {
+		tis.manager.mutex.Lock()
+		tis.manager.remove(tis)
+		tis.manager.mutex.Unlock()
+
+		tis.stream.Close()
+	}()
+
+	// 第一次连接失败时同样按退避时间重连, 观看者等待期间可以查询 connecting/retrying 状态
+	tis.stream.setState(SourceConnecting, "", 0)
+	client, err := tis.connect()
+	if err != nil && !permanentError(err) && !tis.terminated() {
+		log.Printf("[rtsp] %v connect: %v", tis.stream.Name(), err)
+		client = tis.reconnect(err)
+	}
+	if client == nil {
+		if tis.terminated() {
+			err = errSourceClosed
+		}
+		log.Printf("[rtsp] %v give up: %v", tis.stream.Name(), err)
+		tis.err = err
+		close(tis.ready)
+		return
+	}
+	close(tis.ready)
+
+	for {
+		tis.stream.setState(SourcePlaying, "", 0)
+
+		log.Println("[rtsp] wait...")
+		// wait until a fatal error
+		err = client.Wait()
+		tis.setPlaying(false)
+		if tis.terminated() {
+			return
+		}
+		log.Printf("[rtsp] %v disconnected: %v", tis.stream.Name(), err)
+
+		if client = tis.reconnect(err); client == nil {
+			return
+		}
+	}
+}
+
+// permanentError 重连也不能恢复的错误, 第一次连接时不再重试
+func permanentError(err error) bool {
+	return errors.Is(err, ErrNoCommonCodec) || errors.Is(err, ErrNoBackchannel)
+}
+
+// reconnect 指数退避加抖动重连, 停止或不重连时返回nil
+func (tis *rtspSource) reconnect(cause error) *gortsplib.Client {
+	delay, maxDelay := tis.manager.retryMin, tis.manager.retryMax
+	if delay <= 0 {
+		return nil
+	}
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+
+	for retry := 1; ; retry++ {
+		// 抖动: 等待 delay 的 50% ~ 100%, 避免多路流同时重连
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+		tis.stream.setState(SourceRetrying, cause.Error(), retry)
+		log.Printf("[rtsp] %v retry %d in %v", tis.stream.Name(), retry, wait.Round(time.Millisecond))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-tis.terminate:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		tis.stream.setState(SourceConnecting, "", retry)
+		client, err := tis.connect()
+		if err == nil {
+			log.Printf("[rtsp] %v reconnected", tis.stream.Name())
+			return client
+		}
+		if tis.terminated() {
+			return nil
+		}
+		cause = err
+
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// connect 连接, 获取track并开始播放
+func (tis *rtspSource) connect() (*gortsplib.Client, error) {
+	config := tis.manager.clientConfig(tis.address)
+
+	// parse URL
+	u, err := config.url(tis.address)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := config.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if tis.backchannel {
+		c.OnRequest = requireBackchannel
+	}
+
+	// connect to the server
+	if err = c.Start(u.Scheme, u.Host); err != nil {
+		return nil, err
+	}
+
+	// Start之后才能Close; close在此之前调用时由这里断开
+	tis.mutex.Lock()
+	tis.client = c
+	tis.mutex.Unlock()
+	if tis.terminated() {
+		_ = c.Close()
+		return nil, errSourceClosed
+	}
+
+	if err = tis.describe(c, u); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	tis.setPlaying(true)
+	return c, nil
+}
+
+// describe 选择track, setup并play
+func (tis *rtspSource) describe(c *gortsplib.Client, u *url.URL) error {
+	// find published tracks
+	tracks, baseURL, res, err := c.Describe(u)
+	if err != nil {
+		return err
+	}
+
+	// 只打印track, 不打印地址 (可能含密码)
+	for _, track := range tracks {
+		log.Printf("[rtsp] track %v %v", track.GetControl(), trackName(track))
+	}
+
+	// backchannel track 不参与播放
+	var backchannelControls map[string]bool
+	if tis.backchannel {
+		backchannelControls = sendonlyControls(string(res.Body))
+	}
+
+	// 选择第一个支持的视频track和第一个支持的音频track
+	var (
+		selected         = map[string]gortsplib.Track{}
+		codecs           = map[string]webrtc.RTPCodecCapability{}
+		names            []string
+		backchannelTrack gortsplib.Track
+	)
+	for _, track := range tracks {
+		names = append(names, trackName(track))
+
+		if backchannelControls[track.GetControl()] {
+			if _, ok := codecFromTrack(track); ok && backchannelTrack == nil && track.MediaDescription().MediaName.Media == "audio" {
+				backchannelTrack = track
+			}
+			continue
+		}
+
+		media := track.MediaDescription().MediaName.Media
+		if _, ok := selected[media]; ok || (media != "video" && media != "audio") {
+			continue
+		}
+		if codec, ok := codecFromTrack(track); ok {
+			selected[media], codecs[media] = track, codec
+		}
+	}
+
+	// 第一次连接时创建流的全部track, 之后观看者才能订阅; 重连后只setup编码相同的track, 观看者的track不变
+	first := tis.mediaIndexes == nil
+	if first && len(selected) > 0 {
+		tis.mediaIndexes = map[string]int{}
+		tis.rewriters = map[int]*rtpRewriter{}
+		for _, media := range []string{"video", "audio"} {
+			if _, ok := selected[media]; !ok {
+				continue
+			}
+			index := tis.stream.AddTrack(codecs[media])
+			tis.mediaIndexes[media] = index
+			tis.rewriters[index] = newRTPRewriter(codecs[media].ClockRate)
+		}
+		tis.stream.Ready()
+	}
+
+	// rtsp track id (setup顺序) -> stream track序号
+	var trackIndexes []int
+	for _, media := range []string{"video", "audio"} {
+		track, ok := selected[media]
+		if !ok {
+			continue
+		}
+
+		index, ok := tis.mediaIndexes[media]
+		if !ok || !strings.EqualFold(tis.stream.Codecs()[index].MimeType, codecs[media].MimeType) {
+			log.Printf("[rtsp] %v %v changed after reconnect, skip", media, codecs[media].MimeType)
+			continue
+		}
+
+		if _, err = c.Setup(true, track, baseURL, 0, 0); err != nil {
+			return err
+		}
+		trackIndexes = append(trackIndexes, index)
+
+		log.Printf("[rtsp] setup %v %v", media, codecs[media].MimeType)
+	}
+	if len(trackIndexes) == 0 {
+		return fmt.Errorf("%w: rtsp tracks %v", ErrNoCommonCodec, names)
+	}
+
+	// backchannel track 最后setup
+	if tis.backchannel {
+		if backchannelTrack == nil {
+			return fmt.Errorf("%w: %v", ErrNoBackchannel, names)
+		}
+
+		if _, err = c.Setup(true, backchannelTrack, baseURL, 0, 0); err != nil {
+			return err
+		}
+		if first {
+			tis.backchannelTrack = backchannelTrack
+		}
+
+		tis.mutex.Lock()
+		tis.backchannelTrackID = len(trackIndexes)
+		tis.mutex.Unlock()
+
+		log.Printf("[rtsp] setup backchannel %v", trackName(backchannelTrack))
+	}
+
+	// 新会话的序号和时间戳接着上一个会话
+	for _, rewriter := range tis.rewriters {
+		rewriter.reset()
+	}
+
+	// called when a RTP packet arrives
+	c.OnPacketRTP = func(ctx *gortsplib.ClientOnPacketRTPCtx) {
+		if ctx.TrackID < 0 || ctx.TrackID >= len(trackIndexes) {
+			return
+		}
+		index := trackIndexes[ctx.TrackID]
+		tis.rewriters[index].process(ctx.Packet)
+		tis.stream.WriteRTP(index, ctx.Packet)
+	}
+
+	log.Println("[rtsp] play")
+
+	if _, err = c.Play(nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// setPlaying 播放中才能发送backchannel
+func (tis *rtspSource) setPlaying(playing bool) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.playing = playing
+}
+
+// playingClient 播放中的rtsp会话及backchannel track id, 重连时返回nil
+func (tis *rtspSource) playingClient() (*gortsplib.Client, int) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if !tis.playing {
+		return nil, -1
+	}
+	return tis.client, tis.backchannelTrackID
+}
+
+// terminated close已调用
+func (tis *rtspSource) terminated() bool {
+	select {
+	case <-tis.terminate:
+		return true
+	default:
+		return false
+	}
+}
+
+// close 断开rtsp会话, 停止重连
+func (tis *rtspSource) close() {
+	tis.terminateOnce.Do(func() {
+		close(tis.terminate)
+	})
+
+	tis.mutex.Lock()
+	client := tis.client
+	tis.mutex.Unlock()
+
+	if client != nil {
+		_ = client.Close()
+	}
+}
@@ -0,0 +1,359 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// freeAddress 本机空闲的tcp端口
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	return l.Addr().String()
+}
+
+// startTestRtspServer 内置rtsp服务器, 提供 streams 中的流, 返回 rtsp://host:port
+func startTestRtspServer(t *testing.T, streams *StreamRegistry) string {
+	t.Helper()
+
+	return "rtsp://" + listenTestRtspServer(t, streams, freeAddress(t))
+}
+
+// listenTestRtspServer 在address上启动内置rtsp服务器
+func listenTestRtspServer(t *testing.T, streams *StreamRegistry, address string) string {
+	t.Helper()
+
+	listener, err := startRtspListener(streams, NewSourceManager(), nil, nil, RtspListenConfig{Address: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.close() })
+
+	return address
+}
+
+// publishTestStream 注册一路H264流
+func publishTestStream(t *testing.T, streams *StreamRegistry, name string) *Stream {
+	t.Helper()
+
+	stream, err := streams.Publish(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.AddTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000})
+	stream.Ready()
+	t.Cleanup(stream.Close)
+
+	return stream
+}
+
+// sourceCount 管理中的rtsp会话数
+func sourceCount(manager *SourceManager) int {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return len(manager.sources)
+}
+
+func TestSourceManagerRefCount(t *testing.T) {
+	upstream := NewStreamRegistry()
+	server := startTestRtspServer(t, upstream)
+	publishTestStream(t, upstream, "cam1")
+
+	manager := NewSourceManager()
+	manager.linger = 100 * time.Millisecond
+	defer manager.Close()
+
+	address := server + "/cam1"
+	first, err := manager.Subscribe(context.Background(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := manager.Subscribe(context.Background(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一地址共享一个rtsp会话和流
+	if first.Stream() != second.Stream() {
+		t.Error("subscribers of the same address should share one stream")
+	}
+	if got := sourceCount(manager); got != 1 {
+		t.Errorf("sources = %d, want 1", got)
+	}
+	if got := len(first.Tracks); got != 1 {
+		t.Errorf("len(Tracks) = %d, want 1", got)
+	}
+
+	// 还有观看者时不断开
+	first.Close()
+	time.Sleep(2 * manager.linger)
+	if got := sourceCount(manager); got != 1 {
+		t.Fatalf("sources with one viewer = %d, want 1", got)
+	}
+
+	// 最后一个观看者离开 linger 后断开
+	stream := second.Stream()
+	second.Close()
+	select {
+	case <-stream.Done():
+	case <-time.After(10 * manager.linger):
+		t.Fatal("source should be closed after linger")
+	}
+	if got := sourceCount(manager); got != 0 {
+		t.Errorf("sources after linger = %d, want 0", got)
+	}
+}
+
+func TestSourceManagerCredentials(t *testing.T) {
+	upstream := NewStreamRegistry()
+	server := startTestRtspServer(t, upstream)
+	publishTestStream(t, upstream, "cam1")
+
+	manager := NewSourceManager()
+	defer manager.Close()
+
+	// 不同用户名密码的地址不共用rtsp会话
+	host := strings.TrimPrefix(server, "rtsp://")
+	alice, err := manager.Subscribe(context.Background(), "rtsp://alice:secret1@"+host+"/cam1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := manager.Subscribe(context.Background(), "rtsp://bob:secret2@"+host+"/cam1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	if alice.Stream() == bob.Stream() {
+		t.Error("addresses with different credentials should not share a source")
+	}
+	if got := sourceCount(manager); got != 2 {
+		t.Errorf("sources = %d, want 2", got)
+	}
+	for _, sub := range []*Subscriber{alice, bob} {
+		if name := sub.Stream().Name(); strings.Contains(name, "secret") || !strings.HasPrefix(name, server+"/cam1#") {
+			t.Errorf("stream name = %q", name)
+		}
+	}
+}
+
+func TestSourceManagerLinger(t *testing.T) {
+	upstream := NewStreamRegistry()
+	server := startTestRtspServer(t, upstream)
+	publishTestStream(t, upstream, "cam1")
+
+	manager := NewSourceManager()
+	manager.linger = 200 * time.Millisecond
+	defer manager.Close()
+
+	address := server + "/cam1"
+	sub, err := manager.Subscribe(context.Background(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := sub.Stream()
+	sub.Close()
+
+	// linger 期间再次订阅, 沿用原来的rtsp会话
+	time.Sleep(manager.linger / 2)
+	sub, err = manager.Subscribe(context.Background(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if sub.Stream() != stream {
+		t.Error("subscribe during linger should reuse the source")
+	}
+
+	time.Sleep(2 * manager.linger)
+	select {
+	case <-stream.Done():
+		t.Fatal("source closed while it has a viewer")
+	default:
+	}
+}
+
+func TestSourceManagerNotFound(t *testing.T) {
+	server := startTestRtspServer(t, NewStreamRegistry())
+
+	manager := NewSourceManager()
+	manager.retryMin = 0
+	defer manager.Close()
+
+	tests := []struct {
+		name    string
+		address string
+	}{
+		{"missing path", server + "/missing"},
+		{"invalid address", "rtsp://"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := manager.Subscribe(context.Background(), tt.address); err == nil {
+				t.Fatal("Subscribe() should fail")
+			}
+			// 失败的会话被移除
+			deadline := time.Now().Add(time.Second)
+			for sourceCount(manager) != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("failed source should be removed")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestSourceManagerRetryFirstConnect(t *testing.T) {
+	manager := NewSourceManager()
+	manager.retryMin, manager.retryMax = 50*time.Millisecond, 100*time.Millisecond
+	manager.linger = 50 * time.Millisecond
+	defer manager.Close()
+
+	// rtsp服务器稍后启动
+	address := freeAddress(t)
+	upstream := NewStreamRegistry()
+	publishTestStream(t, upstream, "cam1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type result struct {
+		sub *Subscriber
+		err error
+	}
+	subscribed := make(chan result, 1)
+	go func() {
+		sub, err := manager.Subscribe(ctx, "rtsp://"+address+"/cam1")
+		subscribed <- result{sub, err}
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	listenTestRtspServer(t, upstream, address)
+
+	r := <-subscribed
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	sub := r.sub
+	defer sub.Close()
+
+	// 连接成功后状态变为 playing
+	for {
+		state, changed := sub.Stream().State()
+		if state.State == SourcePlaying {
+			break
+		}
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+			t.Fatalf("state = %+v, want playing", state)
+		}
+	}
+}
+
+func TestSourceManagerSubscribeCancel(t *testing.T) {
+	manager := NewSourceManager()
+	manager.retryMin, manager.retryMax = 50*time.Millisecond, 100*time.Millisecond
+	manager.linger = 50 * time.Millisecond
+	defer manager.Close()
+
+	// 没有rtsp服务器, 一直重连
+	address := "rtsp://" + freeAddress(t) + "/cam1"
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := manager.Subscribe(ctx, address)
+		result <- err
+	}()
+
+	// 等待期间可以看到重连状态
+	deadline := time.Now().Add(time.Second)
+	for {
+		stream, err := manager.streams.Get(sourceName(address))
+		if err == nil {
+			if state, _ := stream.State(); state.State == SourceRetrying {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("source should report retrying")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := <-result; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Subscribe() error = %v, want DeadlineExceeded", err)
+	}
+
+	// 没有等待者, linger后停止重连
+	deadline = time.Now().Add(time.Second)
+	for sourceCount(manager) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("source should be removed after the subscriber gave up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRtspConsumerRTP(t *testing.T) {
+	upstream := NewStreamRegistry()
+	server := startTestRtspServer(t, upstream)
+	publishTestStream(t, upstream, "cam1")
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := server + "/cam1"
+	done := make(chan struct{})
+	go func() {
+		RtspConsumerRTP(address, pc, track)
+		close(done)
+	}()
+
+	// 订阅后PeerConnection断开, 返回并取消订阅
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stream, err := defaultSources.streams.Get(sourceName(address))
+		if err == nil && stream.SubscriberCount() == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("RtspConsumerRTP should subscribe the source")
+		}
+		if err != nil && !errors.Is(err, ErrStreamNotFound) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_ = pc.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("RtspConsumerRTP should return after the PeerConnection is closed")
+	}
+}
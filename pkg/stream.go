@@ -0,0 +1,370 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/aler9/gortsplib/pkg/url"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// 流注册表
+// 每路流以路径为名, 一个推流者, 多个订阅者; 推流者离开后流被移除
+
+var (
+	// ErrStreamExists 同名的流已有推流者
+	ErrStreamExists = errors.New("stream already published")
+	// ErrStreamNotFound 流不存在
+	ErrStreamNotFound = errors.New("stream not found")
+	// ErrStreamNotReady 推流者还未添加完track
+	ErrStreamNotReady = errors.New("stream is not ready")
+)
+
+const (
+	// SourceConnecting 正在连接rtsp
+	SourceConnecting = "connecting"
+	// SourcePlaying rtsp播放中
+	SourcePlaying = "playing"
+	// SourceRetrying rtsp断开, 等待重连
+	SourceRetrying = "retrying"
+)
+
+// SourceState 流来源的状态, 推流者没有状态
+type SourceState struct {
+	State string `json:"state"`
+	// Reason 断开原因
+	Reason string `json:"reason,omitempty"`
+	// Retry 第几次重连
+	Retry int       `json:"retry,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// streamName 将请求的流路径或完整地址转换为注册表中的名字
+// "" -> live, "/cam1/" -> cam1, "rtsp://host:8554/cam1" -> cam1
+func streamName(stream string) string {
+	stream = strings.TrimSpace(stream)
+	if stream == "" {
+		stream = RtspURL
+	}
+
+	if strings.Contains(stream, "://") {
+		u, err := url.Parse(stream)
+		if err != nil {
+			return ""
+		}
+		stream = u.Path
+	}
+
+	return strings.Trim(path.Clean("/"+stream), "/")
+}
+
+// StreamRegistry 流注册表, 并发安全
+type StreamRegistry struct {
+	mutex   sync.RWMutex
+	streams map[string]*Stream
+}
+
+func NewStreamRegistry() *StreamRegistry {
+	return &StreamRegistry{
+		streams: map[string]*Stream{},
+	}
+}
+
+// Publish 注册一路流, 同名流已存在时返回 ErrStreamExists
+func (tis *StreamRegistry) Publish(name string) (*Stream, error) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if _, ok := tis.streams[name]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrStreamExists, name)
+	}
+
+	s := &Stream{
+		name:        name,
+		registry:    tis,
+		subscribers: map[*Subscriber]struct{}{},
+		readers:     map[*rtpReader]struct{}{},
+		stateChange: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	tis.streams[name] = s
+
+	return s, nil
+}
+
+// Get 获取流
+func (tis *StreamRegistry) Get(name string) (*Stream, error) {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	s, ok := tis.streams[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrStreamNotFound, name)
+	}
+	return s, nil
+}
+
+// List 所有流
+func (tis *StreamRegistry) List() []*Stream {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	result := make([]*Stream, 0, len(tis.streams))
+	for _, s := range tis.streams {
+		result = append(result, s)
+	}
+	return result
+}
+
+func (tis *StreamRegistry) remove(s *Stream) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.streams[s.name] == s {
+		delete(tis.streams, s.name)
+	}
+}
+
+// Stream 一路流
+type Stream struct {
+	name     string
+	registry *StreamRegistry
+
+	mutex       sync.RWMutex
+	codecs      []webrtc.RTPCodecCapability
+	ready       bool
+	subscribers map[*Subscriber]struct{}
+	readers     map[*rtpReader]struct{}
+	state       SourceState
+	stateChange chan struct{} // 状态改变时关闭并替换
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Name 流名
+func (tis *Stream) Name() string {
+	return tis.name
+}
+
+// Codecs 推流者的track编码
+func (tis *Stream) Codecs() []webrtc.RTPCodecCapability {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	return append([]webrtc.RTPCodecCapability(nil), tis.codecs...)
+}
+
+// SubscriberCount 订阅者数量
+func (tis *Stream) SubscriberCount() int {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	return len(tis.subscribers)
+}
+
+// AddTrack 推流者新增track, 返回track序号; Ready 之后不能再添加, 返回-1
+func (tis *Stream) AddTrack(codec webrtc.RTPCodecCapability) int {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.ready {
+		return -1
+	}
+
+	tis.codecs = append(tis.codecs, codec)
+	return len(tis.codecs) - 1
+}
+
+// Ready 推流者的track已全部添加, 之后才能订阅, 不能再添加track
+func (tis *Stream) Ready() {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.ready = true
+}
+
+// isReady Ready已调用且有track
+func (tis *Stream) isReady() bool {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	return tis.ready && len(tis.codecs) > 0
+}
+
+// WriteRTP 向所有订阅者转发RTP
+func (tis *Stream) WriteRTP(trackIndex int, pkt *rtp.Packet) {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	for sub := range tis.subscribers {
+		if trackIndex >= len(sub.Tracks) {
+			continue
+		}
+
+		// 单个订阅者的写错误不影响其它订阅者
+		_ = sub.Tracks[trackIndex].WriteRTP(pkt)
+	}
+
+	for reader := range tis.readers {
+		reader.onPacket(trackIndex, pkt)
+	}
+}
+
+// rtpReader 非webrtc的订阅者, 如rtsp服务器的读者, 不得修改pkt
+type rtpReader struct {
+	onPacket func(trackIndex int, pkt *rtp.Packet)
+}
+
+// addReader 接收流的RTP包, 返回取消函数
+func (tis *Stream) addReader(onPacket func(trackIndex int, pkt *rtp.Packet)) func() {
+	reader := &rtpReader{onPacket: onPacket}
+
+	tis.mutex.Lock()
+	tis.readers[reader] = struct{}{}
+	tis.mutex.Unlock()
+
+	return func() {
+		tis.mutex.Lock()
+		delete(tis.readers, reader)
+		tis.mutex.Unlock()
+	}
+}
+
+// Subscribe 订阅流, 为每个track创建本地track; Ready 之前返回 ErrStreamNotReady
+func (tis *Stream) Subscribe() (*Subscriber, error) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if !tis.ready || len(tis.codecs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrStreamNotReady, tis.name)
+	}
+
+	sub := &Subscriber{
+		stream: tis,
+		done:   make(chan struct{}),
+	}
+	// msid 只允许 token 字符
+	streamID := strings.Map(func(r rune) rune {
+		if r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.", r)) {
+			return r
+		}
+		return '-'
+	}, tis.name)
+
+	for i, codec := range tis.codecs {
+		track, err := webrtc.NewTrackLocalStaticRTP(codec, fmt.Sprintf("%s-%d", strings.Split(codec.MimeType, "/")[0], i), streamID)
+		if err != nil {
+			return nil, err
+		}
+		sub.Tracks = append(sub.Tracks, track)
+	}
+
+	tis.subscribers[sub] = struct{}{}
+
+	return sub, nil
+}
+
+// State 来源状态, 以及状态改变时关闭的channel
+func (tis *Stream) State() (SourceState, <-chan struct{}) {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	return tis.state, tis.stateChange
+}
+
+// setState 更新来源状态并通知等待者
+func (tis *Stream) setState(state string, reason string, retry int) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.state = SourceState{
+		State:  state,
+		Reason: reason,
+		Retry:  retry,
+		Time:   time.Now(),
+	}
+	close(tis.stateChange)
+	tis.stateChange = make(chan struct{})
+}
+
+// Done 推流者离开后关闭
+func (tis *Stream) Done() <-chan struct{} {
+	return tis.done
+}
+
+// Close 推流者离开, 从注册表移除
+func (tis *Stream) Close() {
+	tis.closeOnce.Do(func() {
+		tis.registry.remove(tis)
+
+		tis.mutex.Lock()
+		tis.subscribers = map[*Subscriber]struct{}{}
+		tis.readers = map[*rtpReader]struct{}{}
+		tis.mutex.Unlock()
+
+		close(tis.done)
+	})
+}
+
+func (tis *Stream) unsubscribe(sub *Subscriber) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	delete(tis.subscribers, sub)
+}
+
+// Subscriber 订阅者
+type Subscriber struct {
+	stream    *Stream
+	onClose   func()
+	closeOnce sync.Once
+	done      chan struct{}
+
+	// Tracks 与 Stream.Codecs 一一对应
+	Tracks []*webrtc.TrackLocalStaticRTP
+}
+
+// Stream 订阅的流
+func (tis *Subscriber) Stream() *Stream {
+	return tis.stream
+}
+
+// Close 取消订阅
+func (tis *Subscriber) Close() {
+	tis.closeOnce.Do(func() {
+		tis.stream.unsubscribe(tis)
+		if tis.onClose != nil {
+			tis.onClose()
+		}
+		close(tis.done)
+	})
+}
+
+// Done 取消订阅后关闭
+func (tis *Subscriber) Done() <-chan struct{} {
+	return tis.done
+}
+
+// watchSubscriber PeerConnection断开后取消订阅, 流结束后断开PeerConnection
+func watchSubscriber(pc *webrtc.PeerConnection, sub *Subscriber) {
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			sub.Close()
+		}
+	})
+
+	go func() {
+		select {
+		case <-sub.stream.Done():
+			_ = pc.Close()
+		case <-sub.Done():
+		}
+	}()
+}
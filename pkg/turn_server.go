@@ -0,0 +1,225 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v2"
+)
+
+// 内置TURN服务器 (pion/turn), 浏览器在对称NAT或防火墙后时通过TURN中继
+// UDP和TCP监听同一端口, 用户名密码按 TURN REST API 方式生成, 每个会话不同
+// 中继只与引擎自身的WebRTC端口交换数据, 不能借用TURN访问内网其它主机
+
+// DefaultTURNPort 内置TURN服务器默认端口
+const DefaultTURNPort = 3478
+
+// TURNConfig 内置TURN服务器配置
+type TURNConfig struct {
+	// PublicIP 浏览器访问TURN服务器及中继使用的地址
+	PublicIP string
+	// Port UDP和TCP监听端口, 默认 DefaultTURNPort
+	Port int
+	// Realm 默认 rtsp_to_webrtc
+	Realm string
+	// TTL 用户名密码有效期, 默认 DefaultTURNCredentialTTL
+	TTL time.Duration
+}
+
+// WithTURNServer 启动内置TURN服务器, 并返回给浏览器
+func WithTURNServer(config TURNConfig) Option {
+	return func(tis *WebRtcEngine) {
+		tis.turnConfig = &config
+	}
+}
+
+// turnServer 内置TURN服务器
+type turnServer struct {
+	config TURNConfig
+	secret string
+	server *turn.Server
+}
+
+// startTURNServer 监听UDP和TCP并启动TURN服务器, 中继只与allow返回true的对端交换数据
+func startTURNServer(config TURNConfig, allow func(peer net.Addr) bool) (*turnServer, error) {
+	publicIP := net.ParseIP(config.PublicIP)
+	if publicIP == nil {
+		return nil, fmt.Errorf("turn: invalid public ip %q", config.PublicIP)
+	}
+	if config.Port == 0 {
+		config.Port = DefaultTURNPort
+	}
+	if config.Realm == "" {
+		config.Realm = "rtsp_to_webrtc"
+	}
+
+	address := net.JoinHostPort("0.0.0.0", strconv.Itoa(config.Port))
+
+	udpListener, err := net.ListenPacket("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+
+	tcpListener, err := net.Listen("tcp4", address)
+	if err != nil {
+		_ = udpListener.Close()
+		return nil, err
+	}
+
+	tis := &turnServer{
+		config: config,
+		secret: newResourceID(),
+	}
+
+	relayAddressGenerator := &relayFilter{
+		RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+			RelayAddress: publicIP,
+			Address:      "0.0.0.0",
+		},
+		allow: allow,
+	}
+
+	tis.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:       config.Realm,
+		AuthHandler: tis.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: relayAddressGenerator,
+			},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{
+				Listener:              tcpListener,
+				RelayAddressGenerator: relayAddressGenerator,
+			},
+		},
+	})
+	if err != nil {
+		_ = udpListener.Close()
+		_ = tcpListener.Close()
+		return nil, err
+	}
+
+	log.Printf("Listening for TURN at %s (udp/tcp), relay %s\n", address, publicIP)
+
+	return tis, nil
+}
+
+// relayFilter 中继地址只与允许的对端交换数据
+// pion/turn v2.0.8 没有 CreatePermission 的回调, 在中继的PacketConn上过滤
+type relayFilter struct {
+	turn.RelayAddressGenerator
+	allow func(peer net.Addr) bool
+}
+
+func (tis *relayFilter) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := tis.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &filteredPacketConn{PacketConn: conn, allow: tis.allow}, addr, nil
+}
+
+// filteredPacketConn 丢弃发往及来自不允许的对端的数据
+type filteredPacketConn struct {
+	net.PacketConn
+	allow func(peer net.Addr) bool
+}
+
+func (tis *filteredPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := tis.PacketConn.ReadFrom(p)
+		if err != nil || tis.allow(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+func (tis *filteredPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !tis.allow(addr) {
+		return 0, fmt.Errorf("turn: relay to %v is not allowed", addr)
+	}
+	return tis.PacketConn.WriteTo(p, addr)
+}
+
+// turnPeers 中继的对端只能是引擎的UDP mux: 本机网卡地址, TURN公网IP及NAT映射的IP, UDP mux的端口
+func (tis *WebRtcEngine) turnPeers() (func(peer net.Addr) bool, error) {
+	port := tis.udpListener.LocalAddr().(*net.UDPAddr).Port
+
+	var ips []net.IP
+	if ip := net.ParseIP(tis.turnConfig.PublicIP); ip != nil {
+		ips = append(ips, ip)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("turn: %w", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+
+	mapped, err := tis.nat.nat1To1IPs()
+	if err != nil {
+		return nil, err
+	}
+	for _, mapping := range mapped {
+		for _, s := range strings.Split(mapping, "/") {
+			if ip := net.ParseIP(s); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+
+	return func(peer net.Addr) bool {
+		udpAddr, ok := peer.(*net.UDPAddr)
+		if !ok || udpAddr.Port != port {
+			return false
+		}
+		for _, ip := range ips {
+			if ip.Equal(udpAddr.IP) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// authenticate 校验 过期时间戳:user 形式的用户名
+func (tis *turnServer) authenticate(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+	expiry := strings.SplitN(username, ":", 2)[0]
+	t, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || t < time.Now().Unix() {
+		log.Printf("[turn] reject %q from %v", username, srcAddr)
+		return nil, false
+	}
+
+	return turn.GenerateAuthKey(username, realm, turnRESTPassword(tis.secret, username)), true
+}
+
+// iceServer 浏览器使用的TURN地址和临时用户名密码
+func (tis *turnServer) iceServer(user string) browserICEServer {
+	username, credential := turnRESTCredential(tis.secret, user, tis.config.TTL)
+
+	host := net.JoinHostPort(tis.config.PublicIP, strconv.Itoa(tis.config.Port))
+	return browserICEServer{
+		URLs: []string{
+			"turn:" + host + "?transport=udp",
+			"turn:" + host + "?transport=tcp",
+		},
+		Username:   username,
+		Credential: credential,
+	}
+}
+
+// close 停止TURN服务器
+func (tis *turnServer) close() error {
+	return tis.server.Close()
+}
@@ -0,0 +1,246 @@
+package pkg
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2"
+)
+
+func TestTurnRESTPassword(t *testing.T) {
+	tests := []struct {
+		secret   string
+		username string
+		want     string
+	}{
+		// RFC 2104 hmac-sha1 测试向量
+		{"key", "The quick brown fox jumps over the lazy dog", "3nybhbi3iqa8ino29wqQcBydtNk="},
+		{"secret", "1700000000:viewer", "oM0zaUZqq3ijUierm/zT52Njhss="},
+	}
+
+	for _, tt := range tests {
+		if got := turnRESTPassword(tt.secret, tt.username); got != tt.want {
+			t.Errorf("turnRESTPassword(%q, %q) = %q, want %q", tt.secret, tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestTurnRESTCredential(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{"ttl", time.Hour, time.Hour},
+		{"default ttl", 0, DefaultTURNCredentialTTL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			username, credential := turnRESTCredential("secret", "viewer", tt.ttl)
+
+			parts := strings.SplitN(username, ":", 2)
+			if len(parts) != 2 || parts[1] != "viewer" {
+				t.Fatalf("username = %q, want <expiry>:viewer", username)
+			}
+			expiry, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := time.Unix(expiry, 0).Sub(now); got < tt.want-time.Second || got > tt.want+time.Second {
+				t.Errorf("expiry in %v, want %v", got, tt.want)
+			}
+			if credential != turnRESTPassword("secret", username) {
+				t.Errorf("credential = %q, want hmac of the username", credential)
+			}
+		})
+	}
+}
+
+func TestTurnAuthenticate(t *testing.T) {
+	server := &turnServer{
+		config: TURNConfig{PublicIP: "203.0.113.1", Port: DefaultTURNPort, Realm: "rtsp_to_webrtc"},
+		secret: "secret",
+	}
+	src := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 50000}
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name     string
+		username string
+		ok       bool
+	}{
+		{"valid", future + ":viewer", true},
+		{"without user", future, true},
+		{"expired", past + ":viewer", false},
+		{"not a timestamp", "viewer", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok := server.authenticate(tt.username, "rtsp_to_webrtc", src)
+			if ok != tt.ok {
+				t.Fatalf("authenticate(%q) ok = %v, want %v", tt.username, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			want := turn.GenerateAuthKey(tt.username, "rtsp_to_webrtc", turnRESTPassword("secret", tt.username))
+			if !bytes.Equal(key, want) {
+				t.Errorf("authenticate(%q) key = %x, want %x", tt.username, key, want)
+			}
+		})
+	}
+
+	// 发给浏览器的用户名密码可以通过认证
+	ice := server.iceServer("viewer")
+	key, ok := server.authenticate(ice.Username, "rtsp_to_webrtc", src)
+	if !ok || !bytes.Equal(key, turn.GenerateAuthKey(ice.Username, "rtsp_to_webrtc", ice.Credential)) {
+		t.Errorf("credential from iceServer() is rejected: %+v", ice)
+	}
+	if want := "turn:203.0.113.1:3478?transport=udp"; len(ice.URLs) == 0 || ice.URLs[0] != want {
+		t.Errorf("URLs = %v, want %v first", ice.URLs, want)
+	}
+}
+
+func TestTurnRelayPeers(t *testing.T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+	allowed, denied := listen(), listen()
+
+	// 只允许中继到allowed的端口, 相当于引擎的UDP mux
+	allowedPort := allowed.LocalAddr().(*net.UDPAddr).Port
+	_, port, _ := net.SplitHostPort(freeAddress(t))
+	config := TURNConfig{PublicIP: "127.0.0.1", Realm: "rtsp_to_webrtc"}
+	config.Port, _ = strconv.Atoi(port)
+	server, err := startTURNServer(config, func(peer net.Addr) bool {
+		udpAddr, ok := peer.(*net.UDPAddr)
+		return ok && udpAddr.Port == allowedPort
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.close() }()
+
+	ice := server.iceServer("viewer")
+	address := net.JoinHostPort("127.0.0.1", port)
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: address,
+		TURNServerAddr: address,
+		Conn:           listen(),
+		Username:       ice.Username,
+		Password:       ice.Credential,
+		Realm:          config.Realm,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err = client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	relay, err := client.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = relay.Close() }()
+
+	// received 在timeout内读到的数据
+	received := func(conn net.PacketConn) (string, net.Addr) {
+		buf := make([]byte, 1500)
+		_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", nil
+		}
+		return string(buf[:n]), addr
+	}
+
+	tests := []struct {
+		name string
+		peer net.PacketConn
+		want bool
+	}{
+		{"engine port", allowed, true},
+		{"other peer", denied, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := relay.WriteTo([]byte("to "+tt.name), tt.peer.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			data, relayAddr := received(tt.peer)
+			if got := data != ""; got != tt.want {
+				t.Fatalf("peer received %q, want relayed %v", data, tt.want)
+			}
+			if !tt.want {
+				// 对端发往中继地址的数据也被丢弃
+				_, _ = tt.peer.WriteTo([]byte("from "+tt.name), relay.LocalAddr())
+				if data, _ = received(relay); data != "" {
+					t.Errorf("relay received %q from a denied peer", data)
+				}
+				return
+			}
+
+			if _, err := tt.peer.WriteTo([]byte("from "+tt.name), relayAddr); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ = received(relay); data != "from "+tt.name {
+				t.Errorf("relay received %q", data)
+			}
+		})
+	}
+}
+
+func TestTurnPeers(t *testing.T) {
+	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = udpListener.Close() }()
+	port := udpListener.LocalAddr().(*net.UDPAddr).Port
+
+	engine := &WebRtcEngine{
+		udpListener: udpListener,
+		turnConfig:  &TURNConfig{PublicIP: "203.0.113.1"},
+		nat:         natConfig{ips: []string{"198.51.100.1/10.0.0.2"}},
+	}
+	allow, err := engine.turnPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		peer net.Addr
+		want bool
+	}{
+		{"loopback", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, true},
+		{"turn public ip", &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: port}, true},
+		{"nat public ip", &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: port}, true},
+		{"other port", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port + 1}, false},
+		{"other host", &net.UDPAddr{IP: net.IPv4(198, 18, 0, 1), Port: port}, false},
+		{"tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allow(tt.peer); got != tt.want {
+				t.Errorf("allow(%v) = %v, want %v", tt.peer, got, tt.want)
+			}
+		})
+	}
+}
@@ -4,12 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"io"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/url"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
@@ -18,98 +19,164 @@ import (
 // 推流
 
 func (tis *WebRtcEngine) WebrtcToRtsp(c *gin.Context) {
-	var offer webrtc.SessionDescription
-	if err := c.ShouldBindJSON(&offer); err != nil {
+	target, err := tis.resolveSource(c.Query("stream"))
+	if err != nil {
 		log.Println(err)
-		c.Abort()
+		c.AbortWithStatus(sourceErrorStatus(err))
 		return
 	}
 
-	peerConnection, err := tis.api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	})
-	if err != nil {
+	var offer webrtc.SessionDescription
+	if err = c.ShouldBindJSON(&offer); err != nil {
 		log.Println(err)
 		c.Abort()
 		return
 	}
 
-	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+	session, _, err := tis.newPublisherPeerConnection(offer, target, nil)
+	if errors.Is(err, ErrStreamExists) {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	} else if errors.Is(err, ErrNoCommonCodec) {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	} else if err != nil {
 		log.Println(err)
 		c.Abort()
 		return
 	}
 
-	if false {
-		// Allow us to receive 1 audio track, and 1 video track
-		if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
-			log.Println(err)
-			c.Abort()
-			return
-		}
+	c.Header(sessionIDHeader, session.ID)
+	c.JSON(http.StatusOK, session.pc.LocalDescription())
+
+	log.Printf("==== havePeerConnection")
+}
+
+// newPublisherPeerConnection 创建推流的PeerConnection并连接rtsp推流到target
+// 内置rtsp服务器直接提供target时不推流, 返回的Client为nil
+// onCandidate为nil时返回前等待ICE收集完成; 否则立即返回, candidate通过onCandidate发送
+func (tis *WebRtcEngine) newPublisherPeerConnection(offer webrtc.SessionDescription, target string, onCandidate func(*webrtc.ICECandidate)) (*Session, *gortsplib.Client, error) {
+	// 注册流, 供其它webrtc请求者订阅
+	stream, err := tis.streams.Publish(streamName(target))
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Set the handler for ICE connection state
-	// This will notify you when the peer has connected/disconnected
-	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		log.Printf("[ice state] Connection State has changed %s \n", connectionState.String())
+	peerConnection, err := tis.api.NewPeerConnection(tis.configuration())
+	if err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
 
-		if connectionState == webrtc.ICEConnectionStateFailed {
-			if closeErr := peerConnection.Close(); closeErr != nil {
-				log.Println(closeErr)
-			}
+	// webrtc断开后移除流, 停止rtsp推流
+	// publishing 在rtsp开始推流后设置, 之前断开时由开始推流处关闭
+	var (
+		mutex      sync.Mutex
+		publishing *gortsplib.Client
+	)
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state != webrtc.PeerConnectionStateClosed && state != webrtc.PeerConnectionStateFailed {
+			return
 		}
-	})
 
-	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate != nil {
-			log.Printf("[ice] OnICECandidate %s \n", candidate.String())
+		mutex.Lock()
+		stream.Close()
+		cli := publishing
+		publishing = nil
+		mutex.Unlock()
+
+		if cli != nil {
+			log.Println("close rtsp")
+			_ = cli.Close()
 		}
 	})
 
-	// 连接rtsp
-	// 添加track
-	// setup and record
-	cli := gortsplib.Client{}
+	videoTransceiver, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		_ = peerConnection.Close()
+		return nil, nil, err
+	}
 
-	// create an H264 track
-	track := &gortsplib.TrackVP8{
-		PayloadType: 96,
+	// Allow us to receive 1 audio track, and 1 video track
+	audioTransceiver, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		_ = peerConnection.Close()
+		return nil, nil, err
 	}
 
-	if err = cli.StartPublishing(RtspURL, gortsplib.Tracks{track}); err != nil {
-		log.Println(err)
-		c.Abort()
-		return
+	// ICE失败时断开, trickle ice时发送candidate
+	watchICE(peerConnection, onCandidate)
+
+	// 协商完成后连接rtsp; 内置rtsp服务器直接提供流时不推流, cli为nil
+	var (
+		cli       *gortsplib.Client
+		targetURL *url.URL
+	)
+	if !tis.servesLocally(target) {
+		config := tis.sources.clientConfig(target)
+		if targetURL, err = config.url(target); err != nil {
+			_ = peerConnection.Close()
+			return nil, nil, err
+		}
+		if cli, err = config.newClient(); err != nil {
+			_ = peerConnection.Close()
+			return nil, nil, err
+		}
 	}
 
+	// track类型 -> rtsp track id, 同时也是流的track序号
+	trackIDs := map[webrtc.RTPCodecType]int{}
+
+	// 会话登记后关闭ready, 转发出错时结束该会话
+	var session *Session
+	ready := make(chan struct{})
+
 	// Set a handler for when a new remote track starts, this handler will forward data to
 	// our UDP listeners.
 	// In your application this is where you would handle/process audio/video
 	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-		go func() {
-			ticker := time.NewTicker(time.Second * 2)
-			for range ticker.C {
-				if rtcpErr := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}}); rtcpErr != nil {
-					fmt.Println(rtcpErr)
-				}
-			}
-		}()
+		// trackIDs 在协商完成 (ready) 前填写, 之后才能读取
+		select {
+		case <-ready:
+		case <-stream.Done():
+			return
+		}
 
-		if remoteTrack.Kind() != webrtc.RTPCodecTypeVideo {
+		trackID, ok := trackIDs[remoteTrack.Kind()]
+		if !ok {
 			return
 		}
 
-		// Create a local track, all our SFU clients will be fed via this track
-		var newTrackErr error
-		tis.localRTPTrack, newTrackErr = webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, "video", "pion")
-		if newTrackErr != nil {
-			panic(newTrackErr)
+		// 断开rtsp推流和PeerConnection, 不影响其它会话
+		// 先记录原因, 关闭rtsp推流也会断开会话
+		stop := func(reason string) {
+			log.Printf("[rtsp] stop publishing %v: %v", stream.Name(), reason)
+			session.setReason(reason)
+			if cli != nil {
+				_ = cli.Close()
+			}
+			session.end(reason)
+		}
+
+		if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+			// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
+			// 流移除 (PeerConnection断开) 后停止
+			go func() {
+				ticker := time.NewTicker(time.Second * 2)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stream.Done():
+						return
+					case <-ticker.C:
+						if rtcpErr := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}}); rtcpErr != nil {
+							log.Println(rtcpErr)
+						}
+					}
+				}
+			}()
 		}
 
 		pkt := &rtp.Packet{}
@@ -117,27 +184,24 @@ func (tis *WebRtcEngine) WebrtcToRtsp(c *gin.Context) {
 		for {
 			n, _, readErr := remoteTrack.Read(rtpBuf)
 			if readErr != nil {
-				panic(readErr)
+				stop(fmt.Sprintf("read %v track: %v", remoteTrack.Kind(), readErr))
+				return
 			}
 
-			// 转发给其它的webrtc请求者
-			if true {
-				// ErrClosedPipe means we don't have any subscribers, this is ok if no peers have connected yet
-				if _, err = tis.localRTPTrack.Write(rtpBuf[:n]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
-					panic(err)
-				}
+			// Unmarshal the packet and update the PayloadType
+			if err := pkt.Unmarshal(rtpBuf[:n]); err != nil {
+				stop(fmt.Sprintf("unmarshal %v rtp: %v", remoteTrack.Kind(), err))
+				return
 			}
 
+			// 转发给其它的webrtc请求者
+			stream.WriteRTP(trackID, pkt)
+
 			// 转发RTSP
-			if true {
-				// Unmarshal the packet and update the PayloadType
-				if err = pkt.Unmarshal(rtpBuf[:n]); err != nil {
-					log.Println(err)
-					break
-				}
-				if err = cli.WritePacketRTP(0, pkt, true); err != nil {
-					log.Println(err)
-					break
+			if cli != nil {
+				if err := cli.WritePacketRTP(trackID, pkt, true); err != nil {
+					stop(fmt.Sprintf("write rtsp: %v", err))
+					return
 				}
 			}
 		}
@@ -146,9 +210,8 @@ func (tis *WebRtcEngine) WebrtcToRtsp(c *gin.Context) {
 
 	// Set the remote SessionDescription
 	if err = peerConnection.SetRemoteDescription(offer); err != nil {
-		log.Println(err)
-		c.Abort()
-		return
+		_ = peerConnection.Close()
+		return nil, nil, err
 	}
 
 	// Create channel that is blocked until ICE Gathering is complete
@@ -157,22 +220,76 @@ func (tis *WebRtcEngine) WebrtcToRtsp(c *gin.Context) {
 	// Create answer
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
-		log.Println(err)
-		c.Abort()
-		return
+		_ = peerConnection.Close()
+		return nil, nil, err
 	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
-		log.Println(err)
-		c.Abort()
-		return
+		_ = peerConnection.Close()
+		return nil, nil, err
 	}
 
-	log.Println("wait PeerConnection complete")
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
+	// 浏览器使用协商结果中的第一个编码, 以此创建rtsp track
+	var tracks gortsplib.Tracks
+	for _, transceiver := range []*webrtc.RTPTransceiver{videoTransceiver, audioTransceiver} {
+		// offer中没有该类型
+		if transceiver.Mid() == "" {
+			continue
+		}
 
-	c.JSON(http.StatusOK, peerConnection.LocalDescription())
+		codecs := transceiver.Receiver().GetParameters().Codecs
+		if len(codecs) == 0 {
+			continue
+		}
 
-	log.Printf("==== havePeerConnection")
+		track, err := trackFromCodec(codecs[0])
+		if err != nil {
+			_ = peerConnection.Close()
+			return nil, nil, err
+		}
+
+		trackIDs[transceiver.Kind()] = len(tracks)
+		tracks = append(tracks, track)
+		stream.AddTrack(codecs[0].RTPCodecCapability)
+
+		log.Printf("[rtsp] publish %v %v to %v", transceiver.Kind(), codecs[0].MimeType, redactAddress(target))
+	}
+	if len(tracks) == 0 {
+		_ = peerConnection.Close()
+		return nil, nil, fmt.Errorf("%w: offer has no supported codec", ErrNoCommonCodec)
+	}
+	stream.Ready()
+
+	// 连接rtsp
+	// 添加track
+	// setup and record
+	if cli != nil {
+		if err = cli.StartPublishing(targetURL.String(), tracks); err != nil {
+			_ = peerConnection.Close()
+			return nil, nil, err
+		}
+
+		mutex.Lock()
+		select {
+		case <-stream.Done():
+			// 推流开始前webrtc已断开
+			mutex.Unlock()
+			_ = cli.Close()
+			return nil, nil, fmt.Errorf("webrtc closed before publishing to %s", redactAddress(target))
+		default:
+			publishing = cli
+			mutex.Unlock()
+		}
+	}
+
+	// 流移除后移除会话
+	session = tis.sessions.add(SessionPublish, stream, peerConnection, stream.Done())
+	close(ready)
+
+	if onCandidate == nil {
+		log.Println("wait PeerConnection complete")
+		// Block until ICE Gathering is complete, disabling trickle ICE
+		// we do this because we only can exchange one signaling message
+		<-gatherComplete
+	}
+
+	return session, cli, nil
 }
@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// startTestPublisher 浏览器端推流, 通过WHIP交换offer/answer, 之后持续发送H264直到测试结束
+func startTestPublisher(t *testing.T, router http.Handler, target string) string {
+	t.Helper()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	track := newTestVideoTrack(t)
+	if _, err = pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+
+	req := httptest.NewRequest(http.MethodPost, "/whip?stream="+target, strings.NewReader(pc.LocalDescription().SDP))
+	req.Header.Set("Content-Type", "application/sdp")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /whip status = %d", w.Code)
+	}
+
+	answer, _ := io.ReadAll(w.Body)
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestSamples(t, track)
+
+	return w.Header().Get(sessionIDHeader)
+}
+
+// newTestVideoTrack H264 track
+func newTestVideoTrack(t *testing.T) *webrtc.TrackLocalStaticSample {
+	t.Helper()
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+// writeTestSamples 持续发送H264直到测试结束
+func writeTestSamples(t *testing.T, track *webrtc.TrackLocalStaticSample) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = track.WriteSample(media.Sample{Data: []byte{0x00, 0x00, 0x00, 0x01, 0x65, 0x88, 0x84}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+}
+
+func TestPublishSessionReason(t *testing.T) {
+	upstream := NewStreamRegistry()
+	address := freeAddress(t)
+	listener, err := startRtspListener(upstream, NewSourceManager(), nil, nil, RtspListenConfig{Address: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.close() }()
+
+	engine, err := NewWebRtcEngine(WithListenAddress(":0"), WithRtspServer("rtsp://"+address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = engine.Close() }()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/whip", engine.WhipOffer)
+
+	session, err := engine.sessions.Get(startTestPublisher(t, router, "desktop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 等待rtsp服务器收到推流
+	var stream *Stream
+	deadline := time.Now().Add(5 * time.Second)
+	for stream == nil {
+		if stream, err = upstream.Get("desktop"); err != nil && time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	received := make(chan struct{}, 1)
+	cancel := stream.addReader(func(trackIndex int, pkt *rtp.Packet) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	})
+	defer cancel()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rtsp server received no packet")
+	}
+
+	// rtsp服务器断开, 会话以rtsp错误结束, 而不是PeerConnection的closed
+	_ = listener.close()
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session is not closed after the rtsp server left")
+	}
+	if reason := session.Reason(); !strings.Contains(reason, "rtsp") {
+		t.Errorf("Reason() = %q, want an rtsp error", reason)
+	}
+}
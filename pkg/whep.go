@@ -0,0 +1,236 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v3"
+)
+
+// WHEP拉流 (WebRTC-HTTP Egress Protocol)
+// POST   /whep      application/sdp offer, 返回 201 + Location + answer
+// PATCH  /whep/:id  application/trickle-ice-sdpfrag, trickle ice
+// DELETE /whep/:id  结束会话
+
+const (
+	mimeTypeSDP         = "application/sdp"
+	mimeTypeTrickleFrag = "application/trickle-ice-sdpfrag"
+)
+
+// newResourceID 生成资源ID
+func newResourceID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// readSDPBody 读取 application/sdp 请求体
+func readSDPBody(c *gin.Context, sdpType webrtc.SDPType) (webrtc.SessionDescription, bool) {
+	if !strings.HasPrefix(c.ContentType(), mimeTypeSDP) {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return webrtc.SessionDescription{}, false
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil || len(body) == 0 {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return webrtc.SessionDescription{}, false
+	}
+
+	return webrtc.SessionDescription{Type: sdpType, SDP: string(body)}, true
+}
+
+// writeSDPAnswer 返回 201 + Location + answer
+func writeSDPAnswer(c *gin.Context, location string, answer *webrtc.SessionDescription) {
+	c.Header("Location", location)
+	c.Data(http.StatusCreated, mimeTypeSDP, []byte(answer.SDP))
+}
+
+// allowCORS 跨域的WHEP/WHIP播放器, 预检之后的每个应答 (包括错误) 也需要CORS头
+func allowCORS(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Access-Control-Expose-Headers", "Location, ETag, Link, X-Session-Id")
+}
+
+// sdpFrag trickle-ice-sdpfrag 内容
+type sdpFrag struct {
+	ICEUfrag   string
+	ICEPwd     string
+	Candidates []webrtc.ICECandidateInit
+}
+
+// parseSDPFrag 解析 application/trickle-ice-sdpfrag
+func parseSDPFrag(frag string) (*sdpFrag, error) {
+	var (
+		result     = &sdpFrag{}
+		mid        string
+		lineIndex  uint16
+		seenMedias bool
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(frag))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.HasPrefix(line, "m="):
+			if seenMedias {
+				lineIndex++
+				mid = ""
+			}
+			seenMedias = true
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			result.ICEUfrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			result.ICEPwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+			}
+			if mid != "" {
+				m := mid
+				candidate.SDPMid = &m
+			} else {
+				index := lineIndex
+				candidate.SDPMLineIndex = &index
+			}
+			result.Candidates = append(result.Candidates, candidate)
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+// addICECandidates 添加远端候选
+func addICECandidates(pc *webrtc.PeerConnection, candidates []webrtc.ICECandidateInit) error {
+	for _, candidate := range candidates {
+		if err := pc.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WhepOptions 预检请求
+func (tis *WebRtcEngine) WhepOptions(c *gin.Context) {
+	allowCORS(c)
+	c.Header("Access-Control-Allow-Methods", "OPTIONS, POST, PATCH, DELETE")
+	c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+	c.Header("Accept-Post", mimeTypeSDP)
+	tis.writeICELinks(c)
+	c.Status(http.StatusNoContent)
+}
+
+// WhepOffer 创建WHEP会话, 拉取rtsp流播放
+func (tis *WebRtcEngine) WhepOffer(c *gin.Context) {
+	allowCORS(c)
+
+	source, err := tis.resolveSource(c.Query("stream"))
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(sourceErrorStatus(err))
+		return
+	}
+
+	offer, ok := readSDPBody(c, webrtc.SDPTypeOffer)
+	if !ok {
+		return
+	}
+
+	subscriber, backchannel, err := tis.subscribeSource(c.Request.Context(), source, c.Query("backchannel") != "")
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(playErrorStatus(err))
+		return
+	}
+
+	// offer错误 400, 没有共同编码 406, 其它为服务器错误 500; rtsp拉流错误已在订阅时返回 502
+	session, err := tis.newPlayerPeerConnection(offer, subscriber, backchannel, nil)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(answerErrorStatus(err))
+		return
+	}
+
+	// 资源ID即会话ID, 断开后由 SessionManager 移除
+	c.Header(sessionIDHeader, session.ID)
+	tis.writeICELinks(c)
+	writeSDPAnswer(c, c.FullPath()+"/"+session.ID, session.pc.LocalDescription())
+
+	log.Printf("==== whep session %v", session.ID)
+}
+
+// WhepPatch trickle ice
+func (tis *WebRtcEngine) WhepPatch(c *gin.Context) {
+	allowCORS(c)
+
+	session, err := tis.loadSession(c.Param("id"), SessionPlay)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if !strings.HasPrefix(c.ContentType(), mimeTypeTrickleFrag) {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	frag, err := parseSDPFrag(string(body))
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if err = addICECandidates(session.pc, frag.Candidates); err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// WhepDelete 结束WHEP会话
+func (tis *WebRtcEngine) WhepDelete(c *gin.Context) {
+	allowCORS(c)
+
+	session, err := tis.loadSession(c.Param("id"), SessionPlay)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	session.end("deleted")
+
+	c.Status(http.StatusNoContent)
+}
+
+// loadSession WHEP/WHIP资源对应的会话, 资源ID即会话ID, kind不同时视为不存在
+func (tis *WebRtcEngine) loadSession(id string, kind string) (*Session, error) {
+	session, err := tis.sessions.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if session.Kind != kind {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	return session, nil
+}
@@ -0,0 +1,262 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestParseSDPFrag(t *testing.T) {
+	mid := func(s string) *string { return &s }
+	index := func(i uint16) *uint16 { return &i }
+
+	tests := []struct {
+		name string
+		frag string
+		want *sdpFrag
+	}{
+		{
+			name: "empty",
+			frag: "",
+			want: &sdpFrag{},
+		},
+		{
+			name: "credentials only",
+			frag: "a=ice-ufrag:abcd\r\na=ice-pwd:secret\r\n",
+			want: &sdpFrag{ICEUfrag: "abcd", ICEPwd: "secret"},
+		},
+		{
+			name: "candidates with mid",
+			frag: "a=ice-ufrag:abcd\r\n" +
+				"a=ice-pwd:secret\r\n" +
+				"m=audio 9 UDP/TLS/RTP/SAVPF 0\r\n" +
+				"a=mid:0\r\n" +
+				"a=candidate:1 1 udp 2122260223 192.168.1.2 50000 typ host\r\n" +
+				"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+				"a=mid:1\r\n" +
+				"a=candidate:2 1 udp 2122260223 192.168.1.2 50001 typ host\r\n" +
+				"a=end-of-candidates\r\n",
+			want: &sdpFrag{
+				ICEUfrag: "abcd",
+				ICEPwd:   "secret",
+				Candidates: []webrtc.ICECandidateInit{
+					{Candidate: "candidate:1 1 udp 2122260223 192.168.1.2 50000 typ host", SDPMid: mid("0")},
+					{Candidate: "candidate:2 1 udp 2122260223 192.168.1.2 50001 typ host", SDPMid: mid("1")},
+				},
+			},
+		},
+		{
+			name: "candidates without mid use the m-line index",
+			frag: "m=audio 9 UDP/TLS/RTP/SAVPF 0\n" +
+				"a=candidate:1 1 udp 1 10.0.0.1 1000 typ host\n" +
+				"m=video 9 UDP/TLS/RTP/SAVPF 96\n" +
+				"a=candidate:2 1 udp 1 10.0.0.1 1001 typ host\n",
+			want: &sdpFrag{
+				Candidates: []webrtc.ICECandidateInit{
+					{Candidate: "candidate:1 1 udp 1 10.0.0.1 1000 typ host", SDPMLineIndex: index(0)},
+					{Candidate: "candidate:2 1 udp 1 10.0.0.1 1001 typ host", SDPMLineIndex: index(1)},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSDPFrag(tt.frag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSDPFrag() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhepCORS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	engine := &WebRtcEngine{sessions: NewSessionManager()}
+	r := gin.New()
+	r.OPTIONS("/whep", engine.WhepOptions)
+	r.POST("/whep", engine.WhepOffer)
+	r.PATCH("/whep/:id", engine.WhepPatch)
+	r.DELETE("/whep/:id", engine.WhepDelete)
+	r.OPTIONS("/whip", engine.WhipOptions)
+	r.PATCH("/whip/:id", engine.WhipPatch)
+	r.DELETE("/whip/:id", engine.WhipDelete)
+
+	tests := []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodOptions, "/whep", http.StatusNoContent},
+		{http.MethodOptions, "/whip", http.StatusNoContent},
+		{http.MethodPost, "/whep?stream=rtsp://example.com/live", http.StatusForbidden},
+		{http.MethodPatch, "/whep/unknown", http.StatusNotFound},
+		{http.MethodDelete, "/whep/unknown", http.StatusNotFound},
+		{http.MethodPatch, "/whip/unknown", http.StatusNotFound},
+		{http.MethodDelete, "/whip/unknown", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader("")))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+				t.Errorf("Access-Control-Allow-Origin = %q", got)
+			}
+			if got := w.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(got, "Location") {
+				t.Errorf("Access-Control-Expose-Headers = %q", got)
+			}
+		})
+	}
+}
+
+func TestWhepDelete(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	engine := &WebRtcEngine{sessions: NewSessionManager()}
+	engine.sessions.onEvent = nil
+	r := gin.New()
+	r.DELETE("/whep/:id", engine.WhepDelete)
+	r.DELETE("/whip/:id", engine.WhipDelete)
+
+	stream, err := NewStreamRegistry().Publish("live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	session := engine.sessions.add(SessionPlay, stream, pc, done)
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		// WHIP不能删除播放会话
+		{"/whip/" + session.ID, http.StatusNotFound},
+		{"/whep/" + session.ID, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, tt.target, nil))
+		if w.Code != tt.status {
+			t.Errorf("DELETE %s = %d, want %d", tt.target, w.Code, tt.status)
+		}
+	}
+
+	if state := pc.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+		t.Errorf("PeerConnection state = %v, want closed", state)
+	}
+	if reason := session.Reason(); reason != "deleted" {
+		t.Errorf("reason = %q, want deleted", reason)
+	}
+}
+
+func TestAnswerErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"no common codec", ErrNoCommonCodec, http.StatusNotAcceptable},
+		{"invalid offer", ErrInvalidOffer, http.StatusBadRequest},
+		{"server", errors.New("set local description"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := answerErrorStatus(tt.err); got != tt.want {
+				t.Errorf("answerErrorStatus() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// testViewerOffer 只接收视频的浏览器offer
+func testViewerOffer(t *testing.T) string {
+	t.Helper()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	return offer.SDP
+}
+
+func TestWhepOfferStatus(t *testing.T) {
+	address := freeAddress(t)
+	engine, err := NewWebRtcEngine(
+		WithListenAddress(":0"),
+		WithRtspServer("rtsp://"+address),
+		WithRtspListen(RtspListenConfig{Address: address}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = engine.Close() }()
+	engine.sessions.onEvent = nil
+	publishTestStream(t, engine.streams, "cam1")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/whep", engine.WhepOffer)
+
+	tests := []struct {
+		name   string
+		stream string
+		offer  string
+		status int
+	}{
+		{"answer", "cam1", testViewerOffer(t), http.StatusCreated},
+		{"no common codec", "cam1", testOffer, http.StatusNotAcceptable},
+		{"invalid offer", "cam1", "v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 102\r\na=rtpmap:102 H264/90000\r\n", http.StatusBadRequest},
+		{"not allowed", "rtsp://192.168.1.10/stream1", testViewerOffer(t), http.StatusForbidden},
+		{"upstream unavailable", "missing", testViewerOffer(t), http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			req := httptest.NewRequest(http.MethodPost, "/whep?stream="+tt.stream, strings.NewReader(tt.offer)).WithContext(ctx)
+			req.Header.Set("Content-Type", "application/sdp")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("POST /whep status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// WHIP推流 (WebRTC-HTTP Ingestion Protocol)
+// POST   /whip      application/sdp offer, 返回 201 + Location + ETag + answer
+// PATCH  /whip/:id  application/trickle-ice-sdpfrag, trickle ice 或 ice restart
+// DELETE /whip/:id  结束推流
+
+// WhipOptions 预检请求
+func (tis *WebRtcEngine) WhipOptions(c *gin.Context) {
+	tis.WhepOptions(c)
+}
+
+// WhipOffer 创建WHIP会话, 推流到rtsp
+func (tis *WebRtcEngine) WhipOffer(c *gin.Context) {
+	allowCORS(c)
+
+	target, err := tis.resolveSource(c.Query("stream"))
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(sourceErrorStatus(err))
+		return
+	}
+
+	offer, ok := readSDPBody(c, webrtc.SDPTypeOffer)
+	if !ok {
+		return
+	}
+
+	publisher, cli, err := tis.newPublisherPeerConnection(offer, target, nil)
+	if errors.Is(err, ErrStreamExists) {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	} else if errors.Is(err, ErrNoCommonCodec) {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	// rtsp推流结束后断开; 内置rtsp服务器直接提供流时没有rtsp推流
+	if cli != nil {
+		go func() {
+			err := cli.Wait()
+
+			// webrtc断开时先移除流再关闭推流, 保留webrtc的结束原因
+			select {
+			case <-publisher.source.Done():
+			default:
+				publisher.end(fmt.Sprintf("rtsp publishing: %v", err))
+			}
+		}()
+	}
+
+	// 资源ID即会话ID, 断开后由 SessionManager 移除
+	c.Header("ETag", publisher.renewETag())
+	c.Header(sessionIDHeader, publisher.ID)
+	tis.writeICELinks(c)
+	writeSDPAnswer(c, c.FullPath()+"/"+publisher.ID, publisher.pc.LocalDescription())
+
+	log.Printf("==== whip session %v", publisher.ID)
+}
+
+// WhipPatch trickle ice / ice restart
+func (tis *WebRtcEngine) WhipPatch(c *gin.Context) {
+	allowCORS(c)
+
+	session, err := tis.loadSession(c.Param("id"), SessionPublish)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if !strings.HasPrefix(c.ContentType(), mimeTypeTrickleFrag) {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch != "" && !session.matchETag(ifMatch) {
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	frag, err := parseSDPFrag(string(body))
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	session.negotiation.Lock()
+	remoteUfrag, _, err := iceCredentials(session.pc.RemoteDescription().SDP)
+	if err != nil {
+		session.negotiation.Unlock()
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if frag.ICEUfrag == "" || frag.ICEUfrag == remoteUfrag {
+		// trickle ice
+		err = addICECandidates(session.pc, frag.Candidates)
+		session.negotiation.Unlock()
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	// ice restart, If-Match 须为 * 或当前ETag
+	if ifMatch == "" {
+		session.negotiation.Unlock()
+		c.AbortWithStatus(http.StatusPreconditionRequired)
+		return
+	}
+
+	gatherComplete, err := restartICE(session.pc, frag)
+	if err != nil {
+		session.negotiation.Unlock()
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	etag := session.renewETag()
+	session.negotiation.Unlock()
+
+	// 不持锁等待本端候选收集完成, 请求取消时放弃
+	select {
+	case <-gatherComplete:
+	case <-c.Request.Context().Done():
+		return
+	}
+
+	localFrag, err := iceFrag(session.pc.LocalDescription().SDP)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("ETag", etag)
+	c.Data(http.StatusOK, mimeTypeTrickleFrag, []byte(localFrag))
+}
+
+// WhipDelete 结束WHIP会话
+func (tis *WebRtcEngine) WhipDelete(c *gin.Context) {
+	allowCORS(c)
+
+	session, err := tis.loadSession(c.Param("id"), SessionPublish)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	// 断开PeerConnection, rtsp推流随之停止
+	session.end("deleted")
+
+	c.Status(http.StatusNoContent)
+}
+
+// renewETag 生成并记录会话新的ETag
+func (tis *Session) renewETag() string {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.etag = fmt.Sprintf("\"%s\"", newResourceID())
+	return tis.etag
+}
+
+// matchETag If-Match 为 * 或当前ETag
+func (tis *Session) matchETag(ifMatch string) bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return ifMatch == "*" || ifMatch == tis.etag
+}
+
+// iceCredentials 获取SDP中的ice-ufrag, ice-pwd, 会话级优先, 否则取第一个媒体的
+func iceCredentials(description string) (string, string, error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(description)); err != nil {
+		return "", "", err
+	}
+
+	ufrag, _ := desc.Attribute("ice-ufrag")
+	pwd, _ := desc.Attribute("ice-pwd")
+	for _, media := range desc.MediaDescriptions {
+		if ufrag == "" {
+			ufrag, _ = media.Attribute("ice-ufrag")
+		}
+		if pwd == "" {
+			pwd, _ = media.Attribute("ice-pwd")
+		}
+	}
+
+	return ufrag, pwd, nil
+}
+
+// restartOffer 用sdpfrag中的新凭证替换上一次的offer, 去掉旧的候选
+func restartOffer(previous string, frag *sdpFrag) (string, error) {
+	if frag.ICEPwd == "" {
+		return "", errors.New("ice-pwd is missing")
+	}
+
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(previous)); err != nil {
+		return "", err
+	}
+
+	replace := func(attributes []sdp.Attribute) []sdp.Attribute {
+		var result []sdp.Attribute
+		for _, attr := range attributes {
+			switch attr.Key {
+			case "ice-ufrag":
+				attr.Value = frag.ICEUfrag
+			case "ice-pwd":
+				attr.Value = frag.ICEPwd
+			case "candidate", "end-of-candidates":
+				continue
+			}
+			result = append(result, attr)
+		}
+		return result
+	}
+
+	desc.Attributes = replace(desc.Attributes)
+	for _, media := range desc.MediaDescriptions {
+		media.Attributes = replace(media.Attributes)
+	}
+
+	data, err := desc.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// restartICE 使用新的远端凭证重新协商, 返回本端候选收集完成时关闭的channel
+func restartICE(pc *webrtc.PeerConnection, frag *sdpFrag) (<-chan struct{}, error) {
+	offer, err := restartOffer(pc.RemoteDescription().SDP, frag)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return nil, err
+	}
+
+	if err = addICECandidates(pc, frag.Candidates); err != nil {
+		return nil, err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = pc.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+
+	return gatherComplete, nil
+}
+
+// iceFrag 本端的凭证和候选, 作为ICE restart的应答; bundle时各媒体的候选相同, 只取第一个媒体的
+func iceFrag(description string) (string, error) {
+	ufrag, pwd, err := iceCredentials(description)
+	if err != nil {
+		return "", err
+	}
+
+	var desc sdp.SessionDescription
+	if err = desc.Unmarshal([]byte(description)); err != nil {
+		return "", err
+	}
+
+	var result strings.Builder
+	result.WriteString("a=ice-ufrag:" + ufrag + "\r\n")
+	result.WriteString("a=ice-pwd:" + pwd + "\r\n")
+
+	if len(desc.MediaDescriptions) > 0 {
+		for _, attr := range desc.MediaDescriptions[0].Attributes {
+			if attr.Key == "candidate" {
+				result.WriteString("a=candidate:" + attr.Value + "\r\n")
+			}
+		}
+	}
+	result.WriteString("a=end-of-candidates\r\n")
+
+	return result.String(), nil
+}
@@ -0,0 +1,240 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// testOffer 浏览器推流的offer, 凭证在媒体级
+const testOffer = "v=0\r\n" +
+	"o=- 4215775240449105457 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=group:BUNDLE 0 1\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=ice-ufrag:old1\r\n" +
+	"a=ice-pwd:oldpassword1234567890\r\n" +
+	"a=fingerprint:sha-256 00:11:22:33\r\n" +
+	"a=setup:actpass\r\n" +
+	"a=mid:0\r\n" +
+	"a=sendonly\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"a=candidate:1 1 udp 2122260223 192.168.1.2 50000 typ host\r\n" +
+	"a=end-of-candidates\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=ice-ufrag:old1\r\n" +
+	"a=ice-pwd:oldpassword1234567890\r\n" +
+	"a=fingerprint:sha-256 00:11:22:33\r\n" +
+	"a=setup:actpass\r\n" +
+	"a=mid:1\r\n" +
+	"a=sendonly\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n" +
+	"a=candidate:1 1 udp 2122260223 192.168.1.2 50000 typ host\r\n"
+
+func TestICECredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		sdp       string
+		wantUfrag string
+		wantPwd   string
+	}{
+		{"media level", testOffer, "old1", "oldpassword1234567890"},
+		{
+			name: "session level",
+			sdp: "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+				"a=ice-ufrag:sess\r\na=ice-pwd:sessionpassword\r\n" +
+				"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=ice-ufrag:media\r\n",
+			wantUfrag: "sess",
+			wantPwd:   "sessionpassword",
+		},
+		{
+			name:      "missing",
+			sdp:       "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n",
+			wantUfrag: "",
+			wantPwd:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ufrag, pwd, err := iceCredentials(tt.sdp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ufrag != tt.wantUfrag || pwd != tt.wantPwd {
+				t.Errorf("iceCredentials() = %q, %q, want %q, %q", ufrag, pwd, tt.wantUfrag, tt.wantPwd)
+			}
+		})
+	}
+
+	if _, _, err := iceCredentials("v=0\r\no=invalid\r\n"); err == nil {
+		t.Error("iceCredentials() of an invalid sdp should fail")
+	}
+}
+
+func TestRestartOffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		frag    *sdpFrag
+		wantErr bool
+	}{
+		{"new credentials", &sdpFrag{ICEUfrag: "new1", ICEPwd: "newpassword1234567890"}, false},
+		{"missing pwd", &sdpFrag{ICEUfrag: "new1"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offer, err := restartOffer(testOffer, tt.frag)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("restartOffer() should fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.Count(offer, "a=ice-ufrag:"+tt.frag.ICEUfrag+"\r\n"); got != 2 {
+				t.Errorf("new ufrag in %d media, want 2:\n%s", got, offer)
+			}
+			if got := strings.Count(offer, "a=ice-pwd:"+tt.frag.ICEPwd+"\r\n"); got != 2 {
+				t.Errorf("new pwd in %d media, want 2:\n%s", got, offer)
+			}
+			for _, removed := range []string{"old1", "oldpassword", "a=candidate:", "a=end-of-candidates"} {
+				if strings.Contains(offer, removed) {
+					t.Errorf("offer still contains %q:\n%s", removed, offer)
+				}
+			}
+			// 其它属性不变
+			for _, kept := range []string{"a=group:BUNDLE 0 1", "a=mid:1", "a=rtpmap:96 VP8/90000", "a=fingerprint:sha-256 00:11:22:33"} {
+				if !strings.Contains(offer, kept) {
+					t.Errorf("offer lost %q:\n%s", kept, offer)
+				}
+			}
+		})
+	}
+}
+
+func TestICEFrag(t *testing.T) {
+	frag, err := iceFrag(testOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "a=ice-ufrag:old1\r\n" +
+		"a=ice-pwd:oldpassword1234567890\r\n" +
+		"a=candidate:1 1 udp 2122260223 192.168.1.2 50000 typ host\r\n" +
+		"a=end-of-candidates\r\n"
+	if frag != want {
+		t.Errorf("iceFrag() = %q, want %q", frag, want)
+	}
+
+	// 应答可以被sdpfrag解析
+	parsed, err := parseSDPFrag(frag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.ICEUfrag != "old1" || len(parsed.Candidates) != 1 {
+		t.Errorf("parseSDPFrag(iceFrag()) = %+v", parsed)
+	}
+}
+
+func TestMatchETag(t *testing.T) {
+	session := &Session{}
+	etag := session.renewETag()
+
+	tests := []struct {
+		ifMatch string
+		want    bool
+	}{
+		{"*", true},
+		{etag, true},
+		{`"other"`, false},
+	}
+	for _, tt := range tests {
+		if got := session.matchETag(tt.ifMatch); got != tt.want {
+			t.Errorf("matchETag(%q) = %v, want %v", tt.ifMatch, got, tt.want)
+		}
+	}
+
+	if renewed := session.renewETag(); renewed == etag || session.matchETag(etag) {
+		t.Error("renewETag() should replace the previous ETag")
+	}
+}
+
+func TestRestartICE(t *testing.T) {
+	browser, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = browser.Close() }()
+	server, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.Close() }()
+
+	if _, err = browser.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatal(err)
+	}
+
+	negotiate := func(options *webrtc.OfferOptions) webrtc.SessionDescription {
+		offer, err := browser.CreateOffer(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = browser.SetLocalDescription(offer); err != nil {
+			t.Fatal(err)
+		}
+		return offer
+	}
+
+	// 第一次协商
+	offer := negotiate(nil)
+	if err = server.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := server.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 与WhipOffer一样, 收集完成后才应答
+	gatherComplete := webrtc.GatheringCompletePromise(server)
+	if err = server.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	if err = browser.SetRemoteDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	oldUfrag, _, _ := iceCredentials(server.LocalDescription().SDP)
+
+	// 浏览器 ICE restart, 只把新凭证通过sdpfrag发给服务端
+	restart := negotiate(&webrtc.OfferOptions{ICERestart: true})
+	ufrag, pwd, err := iceCredentials(restart.SDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gatherComplete, err = restartICE(server, &sdpFrag{ICEUfrag: ufrag, ICEPwd: pwd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+
+	if remote, _, _ := iceCredentials(server.RemoteDescription().SDP); remote != ufrag {
+		t.Errorf("remote ufrag = %q, want %q", remote, ufrag)
+	}
+	frag, err := iceFrag(server.LocalDescription().SDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed, _ := parseSDPFrag(frag); parsed.ICEUfrag == "" || parsed.ICEUfrag == oldUfrag {
+		t.Errorf("local ufrag after restart = %q, old %q", parsed.ICEUfrag, oldUfrag)
+	}
+}